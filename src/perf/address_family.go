@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Address families of the targets of runs and probes.
+const (
+	// Whichever family the target resolves to first.
+	AddressFamilyAny = ""
+
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// Validates an address family preference.
+func checkAddressFamily(family string) error {
+	switch family {
+	case AddressFamilyAny, AddressFamilyIPv4, AddressFamilyIPv6:
+		return nil
+	default:
+		return fmt.Errorf("Invalid address family '%s', must be '%s' or '%s'",
+			family, AddressFamilyIPv4, AddressFamilyIPv6)
+	}
+}
+
+// Network to dial or resolve ("tcp" or "udp") restricted to an address family.
+func familyNetwork(network, family string) string {
+	switch family {
+	case AddressFamilyIPv4:
+		return network + "4"
+	case AddressFamilyIPv6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// Address family of a socket address. IPv4-mapped IPv6 addresses count as IPv4.
+func addressFamily(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	default:
+		return ""
+	}
+	if ip.To4() != nil {
+		return AddressFamilyIPv4
+	}
+	return AddressFamilyIPv6
+}
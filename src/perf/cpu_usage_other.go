@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// The CPU usage is not reported on this platform.
+func readCpuUsage() cpuUsage {
+	return cpuUsage{}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+func readCpuUsage() cpuUsage {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		glog.Warningf("Error reading CPU usage: %s", err)
+		return cpuUsage{}
+	}
+	return cpuUsage{user: usage.Utime.Nano(), system: usage.Stime.Nano()}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errEchoTimeout = errors.New("no echo reply in time")
+
+// Sends the echo requests of a latency probe, and matches the replies.
+type echoClient interface {
+	// Sends a request, and waits for its reply for at most timeout. Returns when the request
+	// was sent, the round-trip time, and the TTL of the reply (its hop limit over IPv6), 0 when
+	// unknown. A request without a reply in time returns when it was sent, and errEchoTimeout.
+	RoundTrip(timeout time.Duration) (time.Time, time.Duration, int, error)
+
+	// Describes the requests sent and their fate.
+	Summary() string
+
+	Close() error
+}
+
+// Reply to an echo request: when it arrived, and its TTL, 0 when unknown.
+type echoReply struct {
+	time time.Time
+	ttl  int
+}
+
+// Echo requests sent by a probe, waiting for their reply or not.
+type echoRequests struct {
+	// Guards the state of the requests, shared with the goroutine reading the replies.
+	mutex sync.Mutex
+
+	// Sequence number of the next request.
+	nextSeq uint64
+
+	// Requests waiting for their reply, by sequence number, with the channel to pass the reply.
+	pending map[uint64]chan echoReply
+
+	// Replies received, in sequence number order or not.
+	replies seqTracker
+
+	// Requests without a reply in time, and replies to them received afterwards.
+	lost uint64
+	late uint64
+
+	// Requests that could not be sent.
+	unsent uint64
+}
+
+func (r *echoRequests) init() {
+	r.pending = make(map[uint64]chan echoReply)
+}
+
+// Registers a new request. Returns its sequence number, and the channel passing its reply.
+func (r *echoRequests) Add() (uint64, chan echoReply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	seq := r.nextSeq
+	r.nextSeq += 1
+	reply := make(chan echoReply, 1)
+	r.pending[seq] = reply
+	return seq, reply
+}
+
+// Accounts for the reply to a request.
+func (r *echoRequests) Reply(seq uint64, reply echoReply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	duplicates := r.replies.Duplicates
+	r.replies.Add(seq)
+	if pending, ok := r.pending[seq]; ok {
+		delete(r.pending, seq)
+		pending <- reply
+	} else if seq < r.nextSeq && r.replies.Duplicates == duplicates {
+		// The first reply to a request no longer waited for:
+		r.late += 1
+	}
+}
+
+// Waits for the reply to a request sent at startTime, for at most timeout, and returns the
+// round-trip time and the TTL of the reply.
+func (r *echoRequests) Wait(seq uint64, reply chan echoReply, startTime time.Time,
+	timeout time.Duration) (time.Duration, int, error) {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case received := <-reply:
+		return received.time.Sub(startTime), received.ttl, nil
+	case <-timer.C:
+		r.Forget(seq, true)
+		return 0, 0, errEchoTimeout
+	}
+}
+
+// Stops waiting for the reply to a request, lost or never sent.
+func (r *echoRequests) Forget(seq uint64, lost bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.pending, seq)
+	if lost {
+		r.lost += 1
+	} else {
+		r.unsent += 1
+	}
+}
+
+// Describes the requests sent and their fate. Requests still waiting for their reply are left
+// out.
+func (r *echoRequests) Summary() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sent := r.nextSeq - uint64(len(r.pending)) - r.unsent
+	var lossPercent float64
+	if sent > 0 {
+		lossPercent = 100 * float64(r.lost) / float64(sent)
+	}
+	return fmt.Sprintf("%d sent, %d lost (%.2f%%), %d late, %d reordered, %d duplicated",
+		sent, r.lost, lossPercent, r.late, r.replies.Reordered, r.replies.Duplicates)
+}
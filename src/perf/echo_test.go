@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newEchoRequests() *echoRequests {
+	r := &echoRequests{}
+	r.init()
+	return r
+}
+
+func TestEchoRequestsReply(t *testing.T) {
+	r := newEchoRequests()
+	start := time.Now()
+	seq, reply := r.Add()
+	r.Reply(seq, echoReply{time: start.Add(3 * time.Millisecond), ttl: 64})
+	rtt, ttl, err := r.Wait(seq, reply, start, time.Second)
+	if err != nil || rtt != 3*time.Millisecond || ttl != 64 {
+		t.Errorf("Expected a 3ms round trip with TTL 64 but got %s, %d (error %v)", rtt, ttl, err)
+	}
+	expected := "1 sent, 0 lost (0.00%), 0 late, 0 reordered, 0 duplicated"
+	if summary := r.Summary(); summary != expected {
+		t.Errorf("Expected summary '%s' but got '%s'", expected, summary)
+	}
+}
+
+func TestEchoRequestsLateReply(t *testing.T) {
+	r := newEchoRequests()
+	seq, reply := r.Add()
+	if _, _, err := r.Wait(seq, reply, time.Now(), time.Millisecond); err != errEchoTimeout {
+		t.Errorf("Expected a timeout but got %v", err)
+	}
+	// The reply after the timeout is late, and the request still lost:
+	r.Reply(seq, echoReply{time: time.Now()})
+	expected := "1 sent, 1 lost (100.00%), 1 late, 0 reordered, 0 duplicated"
+	if summary := r.Summary(); summary != expected {
+		t.Errorf("Expected summary '%s' but got '%s'", expected, summary)
+	}
+}
+
+func TestEchoRequestsOutOfOrder(t *testing.T) {
+	r := newEchoRequests()
+	start := time.Now()
+	var replies []chan echoReply
+	for i := 0; i < 3; i++ {
+		_, reply := r.Add()
+		replies = append(replies, reply)
+	}
+	for _, seq := range []uint64{2, 0, 1, 1} {
+		r.Reply(seq, echoReply{time: start.Add(time.Duration(seq+1) * time.Millisecond)})
+	}
+	// Each request gets its own reply:
+	for seq, reply := range replies {
+		rtt, _, err := r.Wait(uint64(seq), reply, start, time.Second)
+		if err != nil || rtt != time.Duration(seq+1)*time.Millisecond {
+			t.Errorf("Expected a %dms round trip for request %d but got %s (error %v)",
+				seq+1, seq, rtt, err)
+		}
+	}
+	expected := "3 sent, 0 lost (0.00%), 0 late, 2 reordered, 1 duplicated"
+	if summary := r.Summary(); summary != expected {
+		t.Errorf("Expected summary '%s' but got '%s'", expected, summary)
+	}
+}
+
+func TestEchoRequestsForget(t *testing.T) {
+	r := newEchoRequests()
+	// A request that could not be sent, one lost, and one waiting for its reply:
+	unsent, _ := r.Add()
+	r.Forget(unsent, false)
+	lost, _ := r.Add()
+	r.Forget(lost, true)
+	r.Add()
+	expected := "1 sent, 1 lost (100.00%), 0 late, 0 reordered, 0 duplicated"
+	if summary := r.Summary(); summary != expected {
+		t.Errorf("Expected summary '%s' but got '%s'", expected, summary)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 )
@@ -45,3 +46,26 @@ func (h *histogram) Print() {
 		low = high
 	}
 }
+
+func (h *histogram) Copy() *histogram {
+	buckets := make([]int, len(h.buckets))
+	copy(buckets, h.buckets)
+	return &histogram{h.base, buckets}
+}
+
+type histogramBucket struct {
+	// Lower bound of the bucket.
+	// The upper bound is the lower bound of the next bucket, if any.
+	Low   float64 `json:low`
+	Count int     `json:count`
+}
+
+func (h *histogram) MarshalJSON() ([]byte, error) {
+	buckets := make([]histogramBucket, len(h.buckets))
+	var low float64 = 0
+	for i := 0; i < len(h.buckets); i++ {
+		buckets[i] = histogramBucket{low, h.buckets[i]}
+		low = math.Pow(h.base, float64(i))
+	}
+	return json.Marshal(buckets)
+}
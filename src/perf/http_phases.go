@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Names of the phases of an HTTP measurement, in the order of their columns in the .series
+// files, as suffixes of their Datadog metrics.
+var httpPhaseNames = []string{"dns", "connect", "tls", "first_byte", "transfer"}
+
+// Durations of the phases of an HTTP measurement, in nanoseconds. A phase that did not happen
+// lasts 0, e.g. the name resolution of an IP address, or the handshakes over a reused
+// connection.
+type httpPhases struct {
+	dnsNs     uint64
+	connectNs uint64
+	tlsNs     uint64
+
+	// From the end of the request to the first byte of the response.
+	firstByteNs uint64
+
+	// Reading the response body, after its first byte.
+	transferNs uint64
+
+	// Whether the request opened a new connection, rather than reusing one.
+	cold bool
+}
+
+// Durations of the phases, in the order of httpPhaseNames.
+func (p *httpPhases) Columns() []uint64 {
+	return []uint64{p.dnsNs, p.connectNs, p.tlsNs, p.firstByteNs, p.transferNs}
+}
+
+// Whether the request went over a cold (new) or a warm (reused) connection.
+func (p *httpPhases) Connection() string {
+	if p.cold {
+		return "cold"
+	}
+	return "warm"
+}
+
+// Times the phases of an HTTP request. The transport may call the hooks from its own
+// goroutines, even after the request timed out.
+type httpPhaseTrace struct {
+	mutex  sync.Mutex
+	phases httpPhases
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+
+	// Whether the request went over a reused connection. A request failing before it got a
+	// connection counts as cold.
+	reused bool
+}
+
+// Hooks to pass to the request context.
+func (t *httpPhaseTrace) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.start(&t.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.done(&t.dnsStart, &t.phases.dnsNs)
+		},
+		// Happy eyeballs may race connections, of which the first one started counts:
+		ConnectStart: func(network, addr string) {
+			t.start(&t.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				t.done(&t.connectStart, &t.phases.connectNs)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.start(&t.tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.done(&t.tlsStart, &t.phases.tlsNs)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.reused = info.Reused
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.start(&t.wroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			t.start(&t.firstByte)
+			t.done(&t.wroteRequest, &t.phases.firstByteNs)
+		},
+	}
+}
+
+// Records the start of a phase, unless already started.
+func (t *httpPhaseTrace) start(at *time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// Records the duration of a phase, once done.
+func (t *httpPhaseTrace) done(start *time.Time, duration *uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !start.IsZero() && *duration == 0 {
+		*duration = uint64(time.Since(*start).Nanoseconds())
+	}
+}
+
+// Records the end of the response body.
+func (t *httpPhaseTrace) BodyRead() {
+	t.done(&t.firstByte, &t.phases.transferNs)
+}
+
+func (t *httpPhaseTrace) Phases() httpPhases {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	phases := t.phases
+	phases.cold = !t.reused
+	return phases
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+)
+
+func TestHttpPhaseTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	client := server.Client()
+
+	get := func() httpPhases {
+		trace := &httpPhaseTrace{}
+		ctx := httptrace.WithClientTrace(context.Background(), trace.ClientTrace())
+		request, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		rep, err := client.Do(request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		io.Copy(ioutil.Discard, rep.Body)
+		rep.Body.Close()
+		trace.BodyRead()
+		return trace.Phases()
+	}
+
+	// The first request opens a connection to the IP address, that the second one reuses:
+	cold := get()
+	if !cold.cold || cold.dnsNs != 0 || cold.connectNs == 0 || cold.tlsNs != 0 ||
+		cold.firstByteNs == 0 || cold.transferNs == 0 {
+		t.Errorf("Unexpected phases of a cold request: %+v", cold)
+	}
+	warm := get()
+	if warm.cold || warm.connectNs != 0 || warm.firstByteNs == 0 || warm.transferNs == 0 {
+		t.Errorf("Unexpected phases of a warm request: %+v", warm)
+	}
+}
+
+func TestHttpPhaseTraceConnectFailure(t *testing.T) {
+	trace := &httpPhaseTrace{}
+	hooks := trace.ClientTrace()
+	hooks.ConnectStart("tcp", "192.0.2.1:80")
+	hooks.ConnectDone("tcp", "192.0.2.1:80", errors.New("connection refused"))
+	phases := trace.Phases()
+	if !phases.cold || phases.connectNs != 0 {
+		t.Errorf("Expected a failed connection to count as cold without a duration: %+v", phases)
+	}
+}
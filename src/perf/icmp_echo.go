@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IANA protocol numbers of ICMP and ICMPv6, to parse messages.
+const (
+	protocolIcmp   = 1
+	protocolIcmpV6 = 58
+)
+
+// Sends the echo requests of an icmp latency probe, and matches the replies.
+//
+// Requests go through an unprivileged ICMP datagram socket (a "ping socket", which Linux only
+// allows to the groups in net.ipv4.ping_group_range), or else through a raw socket, which
+// requires CAP_NET_RAW. The kernel only passes the replies to its own requests to a ping
+// socket, but a raw socket gets all the ICMP traffic of the host.
+type icmpEchoClient struct {
+	echoRequests
+
+	// ID of the probe, carried by the requests after their sequence number.
+	id   string
+	conn *icmp.PacketConn
+	ipv6 bool
+	raw  bool
+
+	// Where to send the requests, and through which network interface if not 0.
+	dst     net.Addr
+	ifIndex int
+
+	// Identifier of the requests on a raw socket. The kernel picks it for a ping socket.
+	echoId int
+
+	// Guards the TTL of the most recent reply, or its hop limit over IPv6.
+	ttlMutex sync.Mutex
+	ttl      int
+}
+
+// Opens a socket to send requests to target, and starts reading the replies, until closed.
+func newIcmpEchoClient(id string, target *net.IPAddr, source string, iface string) (
+	*icmpEchoClient, error) {
+
+	c := &icmpEchoClient{id: id, ipv6: target.IP.To4() == nil, echoId: rand.Intn(1 << 16)}
+	c.init()
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, err
+		}
+		c.ifIndex = i.Index
+	}
+
+	dgramNetwork, rawNetwork, address := "udp4", "ip4:icmp", "0.0.0.0"
+	if c.ipv6 {
+		dgramNetwork, rawNetwork, address = "udp6", "ip6:ipv6-icmp", "::"
+	}
+	if source != "" {
+		address = source
+	}
+	conn, err := icmp.ListenPacket(dgramNetwork, address)
+	if err != nil {
+		glog.Infof("Cannot open ICMP datagram socket for probe '%s', trying a raw socket: %s",
+			id, err)
+		conn, err = icmp.ListenPacket(rawNetwork, address)
+		if err != nil {
+			return nil, err
+		}
+		c.raw = true
+		c.dst = target
+	} else {
+		c.dst = &net.UDPAddr{IP: target.IP, Zone: target.Zone}
+	}
+	c.conn = conn
+
+	if c.ipv6 {
+		err = conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		err = conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	}
+	if err != nil {
+		glog.Warningf("Not reporting the TTL of ICMP echo replies for probe '%s': %s", id, err)
+	}
+	go c.readReplies()
+	return c, nil
+}
+
+func (c *icmpEchoClient) readReplies() {
+	var buffer = make([]byte, 1500)
+	protocol, replyType := protocolIcmp, icmp.Type(ipv4.ICMPTypeEchoReply)
+	if c.ipv6 {
+		protocol, replyType = protocolIcmpV6, ipv6.ICMPTypeEchoReply
+	}
+	for {
+		var nbytes, ttl int
+		var src net.Addr
+		var err error
+		if c.ipv6 {
+			var cm *ipv6.ControlMessage
+			nbytes, cm, src, err = c.conn.IPv6PacketConn().ReadFrom(buffer)
+			if cm != nil {
+				ttl = cm.HopLimit
+			}
+		} else {
+			var cm *ipv4.ControlMessage
+			nbytes, cm, src, err = c.conn.IPv4PacketConn().ReadFrom(buffer)
+			if cm != nil {
+				ttl = cm.TTL
+			}
+		}
+		now := time.Now()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			glog.V(1).Infof("Error reading ICMP echo replies for probe '%s': %s", c.id, err)
+			continue
+		}
+
+		message, err := icmp.ParseMessage(protocol, buffer[0:nbytes])
+		if err != nil || message.Type != replyType || !sameIP(src, c.dst) {
+			continue
+		}
+		echo, ok := message.Body.(*icmp.Echo)
+		if !ok || (c.raw && echo.ID != c.echoId) || len(echo.Data) < 8 ||
+			!bytes.Equal(echo.Data[8:], []byte(c.id)) {
+			continue
+		}
+		c.ttlMutex.Lock()
+		c.ttl = ttl
+		c.ttlMutex.Unlock()
+		c.Reply(binary.BigEndian.Uint64(echo.Data), echoReply{time: now, ttl: ttl})
+	}
+}
+
+// Whether two addresses carry the same IP address.
+func sameIP(a, b net.Addr) bool {
+	ip := func(addr net.Addr) net.IP {
+		switch addr := addr.(type) {
+		case *net.UDPAddr:
+			return addr.IP
+		case *net.IPAddr:
+			return addr.IP
+		}
+		return nil
+	}
+	return ip(a).Equal(ip(b))
+}
+
+func (c *icmpEchoClient) RoundTrip(timeout time.Duration) (
+	time.Time, time.Duration, int, error) {
+
+	seq, reply := c.Add()
+	data := make([]byte, 8+len(c.id))
+	binary.BigEndian.PutUint64(data, seq)
+	copy(data[8:], c.id)
+	message := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: c.echoId, Seq: int(seq % (1 << 16)), Data: data},
+	}
+	if c.ipv6 {
+		message.Type = ipv6.ICMPTypeEchoRequest
+	}
+	// The kernel computes the checksum of ICMPv6 messages:
+	buffer, err := message.Marshal(nil)
+	if err != nil {
+		c.Forget(seq, false)
+		return time.Time{}, 0, 0, err
+	}
+
+	startTime := time.Now()
+	if c.ipv6 {
+		var cm *ipv6.ControlMessage
+		if c.ifIndex != 0 {
+			cm = &ipv6.ControlMessage{IfIndex: c.ifIndex}
+		}
+		_, err = c.conn.IPv6PacketConn().WriteTo(buffer, cm, c.dst)
+	} else {
+		var cm *ipv4.ControlMessage
+		if c.ifIndex != 0 {
+			cm = &ipv4.ControlMessage{IfIndex: c.ifIndex}
+		}
+		_, err = c.conn.IPv4PacketConn().WriteTo(buffer, cm, c.dst)
+	}
+	if err != nil {
+		c.Forget(seq, false)
+		return time.Time{}, 0, 0, err
+	}
+	rtt, ttl, err := c.Wait(seq, reply, startTime, timeout)
+	return startTime, rtt, ttl, err
+}
+
+func (c *icmpEchoClient) Summary() string {
+	socket := "ping socket"
+	if c.raw {
+		socket = "raw socket"
+	}
+	c.ttlMutex.Lock()
+	ttl := c.ttl
+	c.ttlMutex.Unlock()
+	return fmt.Sprintf("%s, TTL %d (%s)", c.echoRequests.Summary(), ttl, socket)
+}
+
+func (c *icmpEchoClient) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+var (
+	flagDefaultReportIntervalMs = flag.Uint64("default-report-interval-ms", 1000,
+		"Default time interval in between the interval reports of traffic runs")
+	flagReportHistory = flag.Int("report-history", 3600,
+		"Number of interval reports to keep per traffic run; older reports are discarded.")
+)
+
+// Shortest interval between the reports of a traffic run.
+const minReportInterval = 10 * time.Millisecond
+
+// Traffic of a run over one reporting interval.
+type IntervalReport struct {
+	// Bounds of the interval, in UNIX nanoseconds
+	StartTime int64 `json:startTime`
+	EndTime   int64 `json:endTime`
+
+	BytesSent     uint64 `json:bytesSent`
+	BytesReceived uint64 `json:bytesReceived`
+
+	// Rates over the interval, in bytes per second
+	SendRate    float64 `json:sendRate`
+	ReceiveRate float64 `json:receiveRate`
+}
+
+// Cumulative counters of a run at the boundary between two intervals.
+type intervalCounters struct {
+	// In UNIX nanoseconds
+	time int64
+
+	bytesSent       uint64
+	bytesReceived   uint64
+	packetsSent     uint64
+	packetsReceived uint64
+}
+
+// Builds the report of the interval between two sets of cumulative counters.
+func newIntervalReport(start, end *intervalCounters) IntervalReport {
+	sent := end.bytesSent - start.bytesSent
+	received := end.bytesReceived - start.bytesReceived
+	return IntervalReport{
+		StartTime:     start.time,
+		EndTime:       end.time,
+		BytesSent:     sent,
+		BytesReceived: received,
+		SendRate:      averageRate(sent, start.time, end.time),
+		ReceiveRate:   averageRate(received, start.time, end.time),
+	}
+}
+
+// Validates the report interval of a run, and applies the default.
+func checkReportInterval(intervalMs uint64) (uint64, error) {
+	if intervalMs == 0 {
+		intervalMs = *flagDefaultReportIntervalMs
+	}
+	if time.Duration(intervalMs)*time.Millisecond < minReportInterval {
+		return 0, fmt.Errorf("Invalid report interval %d ms, must be at least %s",
+			intervalMs, minReportInterval)
+	}
+	return intervalMs, nil
+}
+
+// Whether a history of reports is full, and its oldest report should be discarded.
+func reportHistoryFull(length int) bool {
+	return length > 0 && length >= *flagReportHistory
+}
+
+// Calls report at every interval, in a separate goroutine, until the returned function is called.
+// Stopping reports the last, partial interval, and waits for the reporting goroutine to exit.
+func startIntervalReports(interval time.Duration, report func()) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-ctx.Done():
+				report()
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+)
+
+// Number of buckets, and base, of the delay variation and inter-arrival histograms.
+// With microsecond samples, the last bucket starts at about 8 seconds.
+const (
+	delayHistogramSize = 24
+	delayHistogramBase = 2.0
+)
+
+// Tracks the delay variation of a flow of timestamped packets.
+//
+// Sender and receiver clocks are not assumed to be synchronized: one-way delays are only
+// reported relative to the smallest delay observed, which cancels any constant clock offset.
+type delayTracker struct {
+	hasPrevious bool
+
+	// Arrival time and transit time (arrival - send time) of the previous packet, in ns.
+	previousArrival int64
+	previousTransit int64
+
+	// Smallest transit time observed so far, in ns.
+	minTransit int64
+
+	// Interarrival jitter as defined by RFC 3550 (section 6.4.1), in ns.
+	jitter float64
+
+	// Largest delay variation observed so far, in ns.
+	maxDelayVariation int64
+
+	// Distribution of the delay variations (transit - smallest transit), in µs.
+	delayVariations *histogram
+
+	// Distribution of the times between consecutive arrivals, in µs.
+	interArrivals *histogram
+}
+
+func newDelayTracker() *delayTracker {
+	return &delayTracker{
+		delayVariations: NewHistogram(delayHistogramSize, delayHistogramBase),
+		interArrivals:   NewHistogram(delayHistogramSize, delayHistogramBase),
+	}
+}
+
+// Accounts for a packet sent and received at the given times, in UNIX nanoseconds.
+func (t *delayTracker) Add(sendTime, arrivalTime int64) {
+	transit := arrivalTime - sendTime
+	if !t.hasPrevious {
+		t.hasPrevious = true
+		t.minTransit = transit
+	} else {
+		// J(i) = J(i-1) + (|D(i-1,i)| - J(i-1)) / 16
+		d := math.Abs(float64(transit - t.previousTransit))
+		t.jitter += (d - t.jitter) / 16
+		t.interArrivals.AddSample(float64(arrivalTime-t.previousArrival) / 1e3)
+	}
+	if transit < t.minTransit {
+		t.minTransit = transit
+	}
+	variation := transit - t.minTransit
+	if variation > t.maxDelayVariation {
+		t.maxDelayVariation = variation
+	}
+	t.delayVariations.AddSample(float64(variation) / 1e3)
+
+	t.previousArrival = arrivalTime
+	t.previousTransit = transit
+}
+
+// Interarrival jitter, in nanoseconds.
+func (t *delayTracker) Jitter() float64 {
+	return t.jitter
+}
+
+// Largest delay variation, in nanoseconds.
+func (t *delayTracker) MaxDelayVariation() int64 {
+	return t.maxDelayVariation
+}
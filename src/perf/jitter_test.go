@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDelayTrackerConstantDelay(t *testing.T) {
+	tracker := newDelayTracker()
+	for i := int64(0); i < 10; i++ {
+		tracker.Add(i*1000000, i*1000000+5000)
+	}
+	if tracker.Jitter() != 0 {
+		t.Errorf("Expected no jitter but got %f ns", tracker.Jitter())
+	}
+	if tracker.MaxDelayVariation() != 0 {
+		t.Errorf("Expected no delay variation but got %d ns", tracker.MaxDelayVariation())
+	}
+	// 10 packets with no delay variation, 9 inter-arrival times of 1000 µs:
+	checkArray(t, tracker.delayVariations.buckets[0:2], []int{10, 0})
+	if tracker.interArrivals.buckets[10] != 9 {
+		t.Errorf("Expected 9 inter-arrival samples in [512--1024[ but got %v",
+			tracker.interArrivals.buckets)
+	}
+}
+
+func TestDelayTrackerJitter(t *testing.T) {
+	tracker := newDelayTracker()
+	tracker.Add(0, 1000)
+	tracker.Add(1000000, 1001000+16000)
+	if tracker.Jitter() != 1000 {
+		t.Errorf("Expected jitter of 1000 ns but got %f ns", tracker.Jitter())
+	}
+	if tracker.MaxDelayVariation() != 16000 {
+		t.Errorf("Expected delay variation of 16000 ns but got %d ns",
+			tracker.MaxDelayVariation())
+	}
+
+	// A packet with a shorter transit time lowers the reference delay:
+	tracker.Add(2000000, 2000500)
+	if tracker.minTransit != 500 {
+		t.Errorf("Expected smallest transit of 500 ns but got %d ns", tracker.minTransit)
+	}
+}
@@ -1,25 +1,141 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/zorkian/go-datadog-api"
 )
 
+// Types of latency probes.
+const (
+	// Times an HTTP GET of the target URL.
+	ProbeHttp = "http"
+
+	// Times the TCP handshake to the target host:port, name resolution excluded.
+	ProbeTcpConnect = "tcp-connect"
+
+	// Times the round trip of a UDP datagram echoed by the UDP sink of the agent at the target
+	// host:port.
+	ProbeUdpEcho = "udp-echo"
+
+	// Times the round trip of an ICMP echo request to the target host.
+	ProbeIcmp = "icmp"
+)
+
+// Validates the type of a probe and its target, and applies the default type (http).
+func checkProbeType(probeType, target string) (string, error) {
+	switch probeType {
+	case "":
+		probeType = ProbeHttp
+	case ProbeHttp:
+	case ProbeTcpConnect, ProbeUdpEcho:
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return "", fmt.Errorf("Invalid %s probe target '%s': %s", probeType, target, err)
+		}
+	case ProbeIcmp:
+		if _, _, err := net.SplitHostPort(target); err == nil || target == "" {
+			return "", fmt.Errorf("Invalid %s probe target '%s', must be a host", probeType, target)
+		}
+	default:
+		return "", fmt.Errorf("Invalid probe type '%s'", probeType)
+	}
+	return probeType, nil
+}
+
+// Status codes of the responses counting as a success, by default.
+const (
+	defaultStatusMin = 200
+	defaultStatusMax = 399
+)
+
+// Largest response body matched against the body regular expression of an http probe.
+const maxHttpProbeBodySize = 1 << 20
+
+// Validates the request and response settings of a probe, which only apply to the http type,
+// and applies their defaults.
+func checkHttpProbe(req *LatencyNewRequest) error {
+	if req.Type != ProbeHttp {
+		if req.Method != "" || len(req.Headers) > 0 || req.Body != "" || req.StatusMin != 0 ||
+			req.StatusMax != 0 || req.BodyRegex != "" || req.FreshConnection {
+			return fmt.Errorf("HTTP request and response settings only apply to %s probes",
+				ProbeHttp)
+		}
+		return nil
+	}
+	if req.Method == "" {
+		req.Method = "GET"
+	}
+	// Validates the method and the target URL:
+	if _, err := http.NewRequest(req.Method, req.Target, nil); err != nil {
+		return fmt.Errorf("Invalid %s probe request: %s", ProbeHttp, err)
+	}
+	// Each missing bound defaults separately, and leaves the range open when the other bound
+	// is out of the default range:
+	if req.StatusMin == 0 {
+		req.StatusMin = defaultStatusMin
+		if req.StatusMax != 0 && req.StatusMax < defaultStatusMin {
+			req.StatusMin = 100
+		}
+	}
+	if req.StatusMax == 0 {
+		req.StatusMax = defaultStatusMax
+		if req.StatusMin > defaultStatusMax {
+			req.StatusMax = 599
+		}
+	}
+	if req.StatusMin < 100 || req.StatusMax > 599 || req.StatusMin > req.StatusMax {
+		return fmt.Errorf("Invalid status range [%d, %d]", req.StatusMin, req.StatusMax)
+	}
+	if _, err := regexp.Compile(req.BodyRegex); err != nil {
+		return fmt.Errorf("Invalid body regular expression '%s': %s", req.BodyRegex, err)
+	}
+	return nil
+}
+
+var errProbeClosed = errors.New("Latency probe closed")
+
 type Sample struct {
 	// Unix time of the measurement
 	timestamp uint64
 
 	// Measured latency, in nanoseconds
 	latencyNs uint64
+
+	// With the http type, phases of the measurement, and whether it opened a new connection
+	phases httpPhases
+
+	// With the http type, whether the request failed: error, or unexpected response
+	failed bool
+
+	// With the udp-echo and icmp types, whether the request got no reply in time, and the TTL
+	// of the reply (its hop limit over IPv6), 0 when unknown
+	lost bool
+	ttl  uint64
+}
+
+// Outcome of the measurements of an http probe over new (cold) or reused (warm) connections.
+type httpConnectionStats struct {
+	// Most recent successful measurement
+	Latency time.Duration
+
+	Succeeded uint64
+	Failed    uint64
 }
 
 type latencyProbe struct {
@@ -28,17 +144,46 @@ type latencyProbe struct {
 	// Time interval between measurements, in milliseconds
 	intervalMs int64
 
-	// Ticker with the time interval specified in `intervalMs`, or nil.
-	ticker *time.Ticker
+	// Guards the measurements and the log file, shared with HTTP handlers.
+	mutex sync.Mutex
 
 	series []Sample
 
-	// Target HTTP URL to probe against
-	target string
+	// Type of probe, and target to probe against: HTTP URL, or host:port.
+	probeType string
+	target    string
+
+	// Takes one measurement: returns when it started, and the latency. The http type also
+	// records the durations of the phases of the request in the sample, and the echo types the
+	// TTL of the reply.
+	measure func(ctx context.Context, sample *Sample) (time.Time, time.Duration, error)
 
 	// Most recent measurement
 	latency time.Duration
 
+	// With the http type, outcome of the measurements over new connections, and over reused
+	// ones.
+	cold httpConnectionStats
+	warm httpConnectionStats
+
+	// Address family preference, and family of the most recent connection to the target.
+	addressFamily string
+	family        string
+
+	// Opens the connections to the target.
+	dialer *net.Dialer
+
+	// Source address and network interface, for the probe types without a dialer.
+	sourceAddress string
+	iface         string
+
+	// With the udp-echo and icmp types, sends the requests once connected.
+	echo echoClient
+
+	// Closed by the goroutine measuring when it exits, and whether the probe was closed since.
+	done   chan struct{}
+	closed bool
+
 	// Total number of measurements
 	counter int64
 
@@ -48,20 +193,69 @@ type latencyProbe struct {
 	logFile *os.File
 
 	client *http.Client
+
+	// With the http type, requests to send, and responses counting as a success: status code
+	// in [statusMin, statusMax], and body matching bodyRegex if any.
+	method    string
+	headers   map[string]string
+	body      string
+	statusMin int
+	statusMax int
+	bodyRegex *regexp.Regexp
 }
 
-func NewLatencyProbe(id, target string, intervalMs int64) *latencyProbe {
+// Builds a probe for a request, measuring every intervalMs.
+func NewLatencyProbe(req *LatencyNewRequest, intervalMs int64) *latencyProbe {
 	bufferSize :=
 		((time.Duration(1) * time.Minute) / (time.Duration(intervalMs) * time.Millisecond))
+	network := "tcp"
+	if req.Type == ProbeUdpEcho {
+		network = "udp"
+	}
 
 	probe := &latencyProbe{
-		id:         id,
-		target:     target,
-		intervalMs: intervalMs,
-		client: &http.Client{
-			Timeout: time.Duration(intervalMs) * time.Millisecond,
+		id:            req.Id,
+		probeType:     req.Type,
+		target:        req.Target,
+		intervalMs:    intervalMs,
+		addressFamily: req.AddressFamily,
+		sourceAddress: req.SourceAddress,
+		iface:         req.Interface,
+		series:        make([]Sample, 0, bufferSize),
+		done:          make(chan struct{}),
+		dialer: &net.Dialer{
+			LocalAddr: sourceAddr(network, req.SourceAddress, req.SourcePort),
+			Control: func(network, address string, rawConn syscall.RawConn) error {
+				return controlInterface(rawConn, req.Interface)
+			},
 		},
-		series: make([]Sample, 0, bufferSize),
+	}
+	switch probe.probeType {
+	case ProbeTcpConnect:
+		probe.measure = probe.measureTcpConnect
+	case ProbeUdpEcho:
+		probe.measure = probe.measureUdpEcho
+	case ProbeIcmp:
+		probe.measure = probe.measureIcmp
+	default:
+		probe.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				DialContext:       probe.dial,
+				DisableKeepAlives: req.FreshConnection,
+			},
+			Timeout: time.Duration(intervalMs) * time.Millisecond,
+		}
+		probe.method = req.Method
+		probe.headers = req.Headers
+		probe.body = req.Body
+		probe.statusMin = req.StatusMin
+		probe.statusMax = req.StatusMax
+		if req.BodyRegex != "" {
+			// Validated by checkHttpProbe:
+			probe.bodyRegex = regexp.MustCompile(req.BodyRegex)
+		}
+		probe.measure = probe.measureHttp
 	}
 
 	logFilePath := path.Join(*flagDataDir, fmt.Sprintf("%s.series", probe.id))
@@ -75,76 +269,394 @@ func NewLatencyProbe(id, target string, intervalMs int64) *latencyProbe {
 	return probe
 }
 
-func (p *latencyProbe) Start() {
-	p.ticker = time.NewTicker(time.Duration(p.intervalMs) * time.Millisecond)
-	go p.run(p.ticker)
+// Starts measuring, until ctx is done.
+func (p *latencyProbe) Start(ctx context.Context) {
+	go func() {
+		defer close(p.done)
+		p.run(ctx)
+	}()
 }
 
-func (p *latencyProbe) Stop() {
-	p.ticker.Stop()
+// Waits for a started probe to stop measuring, once its context is done.
+func (p *latencyProbe) Wait() {
+	<-p.done
 }
 
-func (p *latencyProbe) getLatency() (time.Time, time.Duration, error) {
+func (p *latencyProbe) getLatency(ctx context.Context) (
+	time.Time, time.Duration, Sample, error) {
+
+	var sample Sample
+	startTime, latency, err := p.measure(ctx, &sample)
+
+	// Failed http measurements and lost echo requests are recorded as such, but for the ones
+	// interrupted by the stop of the probe:
+	recorded := err != nil && ctx.Err() == nil && !startTime.IsZero()
+	sample.failed = recorded && p.probeType == ProbeHttp
+	sample.lost = recorded && errors.Is(err, errEchoTimeout)
+
+	// Otherwise, we identify a timeout by looking at the latency:
+	if err != nil && !sample.failed && !sample.lost &&
+		(ctx.Err() != nil || latency < time.Duration(p.intervalMs)*time.Millisecond) {
+		return time.Time{}, 0, sample, err
+	}
+
+	sample.timestamp = uint64(startTime.UnixNano())
+	sample.latencyNs = uint64(latency.Nanoseconds())
+	p.mutex.Lock()
+	p.series = append(p.series, sample)
+	p.mutex.Unlock()
+	if sample.failed || sample.lost {
+		return startTime, latency, sample, err
+	}
+	return startTime, latency, sample, nil
+}
+
+// Times the request up to the response headers. The body transfer is only part of the phases.
+// A response with an unexpected status code or body counts as a failure.
+func (p *latencyProbe) measureHttp(ctx context.Context, sample *Sample) (
+	time.Time, time.Duration, error) {
+
+	trace := &httpPhaseTrace{}
+	ctx = httptrace.WithClientTrace(ctx, trace.ClientTrace())
+	request, err := http.NewRequestWithContext(ctx, p.method, p.target, strings.NewReader(p.body))
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	for name, value := range p.headers {
+		if strings.EqualFold(name, "Host") {
+			request.Host = value
+		} else {
+			request.Header.Set(name, value)
+		}
+	}
 	startTime := time.Now()
-	rep, err := p.client.Get(p.target)
+	rep, err := p.client.Do(request)
 	endTime := time.Now()
 	latency := endTime.Sub(startTime)
 
+	var body []byte
 	if rep != nil && rep.Body != nil {
-		io.Copy(ioutil.Discard, rep.Body)
+		var readErr error
+		if p.bodyRegex != nil {
+			body, readErr = ioutil.ReadAll(io.LimitReader(rep.Body, maxHttpProbeBodySize))
+		}
+		if readErr == nil {
+			_, readErr = io.Copy(ioutil.Discard, rep.Body)
+		}
+		if readErr == nil {
+			trace.BodyRead()
+		}
 		rep.Body.Close()
+		if err == nil {
+			err = readErr
+		}
+	}
+	sample.phases = trace.Phases()
+	if err != nil {
+		return startTime, latency, err
+	}
+	if rep.StatusCode < p.statusMin || rep.StatusCode > p.statusMax {
+		return startTime, latency, fmt.Errorf("Unexpected status %d", rep.StatusCode)
+	}
+	if p.bodyRegex != nil && !p.bodyRegex.Match(body) {
+		return startTime, latency,
+			fmt.Errorf("Response body does not match '%s'", p.bodyRegex)
 	}
+	return startTime, latency, nil
+}
 
-	// We identify a timeout by looking at the Get latency:
-	if err != nil && latency < time.Duration(p.intervalMs)*time.Millisecond {
+// Resolves the target first, so as to only time the handshake, and closes the connection.
+func (p *latencyProbe) measureTcpConnect(ctx context.Context, _ *Sample) (
+	time.Time, time.Duration, error) {
+
+	addr, err := net.ResolveTCPAddr(familyNetwork("tcp", p.addressFamily), p.target)
+	if err != nil {
 		return time.Time{}, 0, err
 	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.intervalMs)*time.Millisecond)
+	defer cancel()
+	startTime := time.Now()
+	conn, err := p.dial(ctx, "tcp", addr.String())
+	latency := time.Since(startTime)
+	if conn != nil {
+		conn.Close()
+	}
+	return startTime, latency, err
+}
 
-	timestampNs := uint64(startTime.UnixNano())
-	p.series = append(p.series, Sample{timestampNs, uint64(latency.Nanoseconds())})
-	return startTime, latency, nil
+// Connects the echo client on first use, and sends one request.
+func (p *latencyProbe) measureUdpEcho(ctx context.Context, sample *Sample) (
+	time.Time, time.Duration, error) {
+
+	timeout := time.Duration(p.intervalMs) * time.Millisecond
+	echo, err := p.getEcho(func() (echoClient, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := p.dial(ctx, "udp", p.target)
+		if err != nil {
+			return nil, err
+		}
+		return newUdpEchoClient(p.id, conn.(*net.UDPConn)), nil
+	})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return roundTrip(echo, timeout, sample)
+}
+
+// Opens the socket on first use, and sends one request.
+func (p *latencyProbe) measureIcmp(ctx context.Context, sample *Sample) (
+	time.Time, time.Duration, error) {
+
+	echo, err := p.getEcho(func() (echoClient, error) {
+		target, err := net.ResolveIPAddr(familyNetwork("ip", p.addressFamily), p.target)
+		if err != nil {
+			return nil, err
+		}
+		echo, err := newIcmpEchoClient(p.id, target, p.sourceAddress, p.iface)
+		if err != nil {
+			return nil, err
+		}
+		p.mutex.Lock()
+		p.family = addressFamily(target)
+		p.mutex.Unlock()
+		return echo, nil
+	})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return roundTrip(echo, time.Duration(p.intervalMs)*time.Millisecond, sample)
+}
+
+// Sends one echo request, and records the TTL of its reply in the sample.
+func roundTrip(echo echoClient, timeout time.Duration, sample *Sample) (
+	time.Time, time.Duration, error) {
+
+	startTime, rtt, ttl, err := echo.RoundTrip(timeout)
+	sample.ttl = uint64(ttl)
+	return startTime, rtt, err
+}
+
+// Returns the echo client of the probe, opened on first use. Fails once the probe is closed.
+func (p *latencyProbe) getEcho(open func() (echoClient, error)) (echoClient, error) {
+	p.mutex.Lock()
+	echo, closed := p.echo, p.closed
+	p.mutex.Unlock()
+	if closed {
+		return nil, errProbeClosed
+	}
+	if echo != nil {
+		return echo, nil
+	}
+	// Only the goroutine measuring opens the client, without holding the lock while it does:
+	echo, err := open()
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		echo.Close()
+		return nil, errProbeClosed
+	}
+	p.echo = echo
+	return echo, nil
 }
 
-func (p *latencyProbe) run(ticker *time.Ticker) {
+// Opens the connections to the target, in the preferred address family if any.
+func (p *latencyProbe) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := p.dialer.DialContext(ctx, familyNetwork(network, p.addressFamily), address)
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	p.family = addressFamily(conn.RemoteAddr())
+	p.mutex.Unlock()
+	return conn, nil
+}
+
+// Most recent measurement.
+func (p *latencyProbe) Latency() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.latency
+}
+
+// With the http type, outcome of the measurements over new connections, and over reused ones.
+func (p *latencyProbe) ConnectionStats() (httpConnectionStats, httpConnectionStats) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.cold, p.warm
+}
+
+// Address family of the most recent connection to the target: ipv4 or ipv6.
+func (p *latencyProbe) Family() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.family
+}
+
+func (p *latencyProbe) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.intervalMs) * time.Millisecond)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			glog.Infof("Stopping latency probe '%s'\n", p.id)
+			return
+		}
+		p.mutex.Lock()
 		p.counter += 1
+		p.mutex.Unlock()
 
-		if timestamp, latency, err := p.getLatency(); err != nil {
-			glog.Infof("Error while sending HTTP request for latency measurement: %s\n", err)
+		// A failed http measurement or a lost echo request comes with its timestamp:
+		if timestamp, latency, sample, err := p.getLatency(ctx); err != nil && timestamp.IsZero() {
+			if ctx.Err() == nil {
+				glog.Infof("Error while measuring %s latency to '%s': %s\n",
+					p.probeType, p.target, err)
+			}
 			continue
 		} else {
-			p.latency = latency
-
-			metric := datadog.Metric{
-				Metric: "network.p2p.latency",
-				Points: []datadog.DataPoint{
-					[2]float64{float64(timestamp.Unix()), latency.Seconds()},
-				},
-				Type: "gauge",
-				Host: "",
-				Tags: []string{
-					fmt.Sprintf("source:%s", serverId), // source host
-					fmt.Sprintf("target:%s", p.id),     // target host
-				},
+			phases := sample.phases
+			if sample.lost {
+				glog.Infof("Lost %s request to '%s': %s\n", p.probeType, p.target, err)
+			} else if err != nil {
+				glog.Infof("Failed measuring %s latency to '%s' over a %s connection: %s\n",
+					p.probeType, p.target, phases.Connection(), err)
+			}
+			p.mutex.Lock()
+			if err == nil {
+				p.latency = latency
 			}
+			if p.probeType == ProbeHttp {
+				stats := &p.warm
+				if phases.cold {
+					stats = &p.cold
+				}
+				if err == nil {
+					stats.Latency = latency
+					stats.Succeeded += 1
+				} else {
+					stats.Failed += 1
+				}
+			}
+			p.mutex.Unlock()
 
-			series := []datadog.Metric{metric}
+			tags := []string{
+				fmt.Sprintf("source:%s", serverId),   // source host
+				fmt.Sprintf("target:%s", p.id),       // target host
+				fmt.Sprintf("family:%s", p.Family()), // ipv4 or ipv6
+				fmt.Sprintf("probe:%s", p.probeType), // http, tcp-connect...
+			}
+			if p.probeType == ProbeHttp {
+				// Cold and warm latency as separate series:
+				tags = append(tags, fmt.Sprintf("connection:%s", phases.Connection()))
+			}
+			metric := func(name string, metricType string, value float64) datadog.Metric {
+				return datadog.Metric{
+					Metric: name,
+					Points: []datadog.DataPoint{
+						[2]float64{float64(timestamp.Unix()), value},
+					},
+					Type: metricType,
+					Host: "",
+					Tags: tags,
+				}
+			}
+
+			var series []datadog.Metric
+			if err == nil {
+				series = append(series, metric("network.p2p.latency", "gauge", latency.Seconds()))
+				if sample.ttl > 0 {
+					series = append(series,
+						metric("network.p2p.latency.ttl", "gauge", float64(sample.ttl)))
+				}
+			}
+			switch p.probeType {
+			case ProbeUdpEcho, ProbeIcmp:
+				if sample.lost {
+					series = append(series, metric("network.p2p.latency.lost", "count", 1))
+				} else {
+					series = append(series, metric("network.p2p.latency.succeeded", "count", 1))
+				}
+			case ProbeHttp:
+				if err == nil {
+					// One metric per phase, e.g. network.p2p.latency.dns:
+					for i, ns := range phases.Columns() {
+						series = append(series, metric("network.p2p.latency."+httpPhaseNames[i],
+							"gauge", time.Duration(ns).Seconds()))
+					}
+					series = append(series, metric("network.p2p.latency.succeeded", "count", 1))
+				} else {
+					series = append(series, metric("network.p2p.latency.failed", "count", 1))
+				}
+			}
 			datadogClient.PostMetrics(series)
 		}
 
+		p.mutex.Lock()
 		if len(p.series) >= cap(p.series) {
-			p.flush()
+			p.flushLocked()
 		}
+		p.mutex.Unlock()
 	}
 }
 
 func (p *latencyProbe) flush() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.flushLocked()
+}
+
+func (p *latencyProbe) flushLocked() {
 	glog.V(1).Infof("Flushing %d samples to %s\n", len(p.series), p.logFilePath)
 	samples := make([]string, len(p.series))
 	for i, sample := range p.series {
-		samples[i] = fmt.Sprintf("%d\t%d\n", sample.timestamp, sample.latencyNs)
+		// Timestamp, latency, then the phases, 1 for a new connection and 1 for a failed
+		// request (0 but for the http type), 1 for a lost request and the TTL of the reply
+		// (0 but for the udp-echo and icmp types):
+		columns := append([]uint64{sample.timestamp, sample.latencyNs}, sample.phases.Columns()...)
+		for _, flag := range []bool{sample.phases.cold, sample.failed, sample.lost} {
+			if flag {
+				columns = append(columns, 1)
+			} else {
+				columns = append(columns, 0)
+			}
+		}
+		columns = append(columns, sample.ttl)
+		fields := make([]string, len(columns))
+		for j, column := range columns {
+			fields[j] = strconv.FormatUint(column, 10)
+		}
+		samples[i] = strings.Join(fields, "\t") + "\n"
 	}
 	p.logFile.WriteString(strings.Join(samples, ""))
 	p.series = p.series[0:0]
 }
+
+// Requests sent by a udp-echo or icmp probe and their fate, or an empty string.
+func (p *latencyProbe) EchoSummary() string {
+	p.mutex.Lock()
+	echo := p.echo
+	p.mutex.Unlock()
+	if echo == nil {
+		return ""
+	}
+	return echo.Summary()
+}
+
+// Releases the log file and the echo connection. The probe must be stopped.
+func (p *latencyProbe) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	if p.echo != nil {
+		p.echo.Close()
+		p.echo = nil
+	}
+	if p.logFile != nil {
+		p.logFile.Close()
+		p.logFile = nil
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 var (
-	probes = make(map[string]*latencyProbe, 10)
+	probes = newRunManager()
 )
 
 func InitLatencyService() {
@@ -24,6 +24,39 @@ type LatencyNewRequest struct {
 	Id         string `json:id`
 	Target     string `json:target`
 	IntervalMs int64  `json:intervalMs`
+
+	// Optional address family of the target: ipv4 or ipv6. By default, whichever family
+	// the target resolves to first.
+	AddressFamily string `json:addressFamily`
+
+	// Optional local IP address and port of the connections to the target, and network interface
+	// they are bound to (SO_BINDTODEVICE). With a source port, connections must not overlap.
+	SourceAddress string `json:sourceAddress`
+	SourcePort    int    `json:sourcePort`
+	Interface     string `json:interface`
+
+	// Type of probe: http (default), timing a request to the Target URL, tcp-connect, timing the
+	// TCP handshake to the Target host:port, udp-echo, timing the round trip of datagrams
+	// echoed by the UDP sink of the agent at the Target host:port, or icmp, timing the round
+	// trip of ICMP echo requests to the Target host.
+	Type string `json:type`
+
+	// With the http type, optional method (GET by default), headers and body of the requests.
+	Method  string            `json:method`
+	Headers map[string]string `json:headers`
+	Body    string            `json:body`
+
+	// With the http type, range of the status codes of the responses counting as a success
+	// (200 to 399 by default, for each bound: a statusMin of 400 alone means 400 to 599), and
+	// optional regular expression their body must match. Other responses count as failed
+	// measurements.
+	StatusMin int    `json:statusMin`
+	StatusMax int    `json:statusMax`
+	BodyRegex string `json:bodyRegex`
+
+	// With the http type, opens a new connection for every request, so as to measure cold
+	// connections only. Measurements over new and reused connections are reported apart.
+	FreshConnection bool `json:freshConnection`
 }
 
 func LatencyNewHandler(w http.ResponseWriter, req *http.Request) {
@@ -36,16 +69,39 @@ func LatencyNewHandler(w http.ResponseWriter, req *http.Request) {
 	if intervalMs == 0 {
 		intervalMs = *flagDefaultIntervalMs
 	}
+	probeType, err := checkProbeType(request.Type, request.Target)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	request.Type = probeType
+	if err := checkHttpProbe(request); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := checkAddressFamily(request.AddressFamily); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := checkSource(request.SourceAddress, request.SourcePort); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
-	if _, exists := probes[request.Id]; exists {
+	if _, exists := probes.Get(request.Id); exists {
 		io.WriteString(w,
 			fmt.Sprintf("Latency probe already exists for ID '%s'", request.Id))
 		return
 	}
 
-	probe := NewLatencyProbe(request.Id, request.Target, intervalMs)
-	probes[request.Id] = probe
-	probe.Start()
+	probe := NewLatencyProbe(request, intervalMs)
+	if ctx, ok := probes.Add(request.Id, probe); ok {
+		probe.Start(ctx)
+	} else {
+		probe.Close()
+		io.WriteString(w,
+			fmt.Sprintf("Latency probe already exists for ID '%s'", request.Id))
+	}
 }
 
 // -------------------------------------------------------------------------------------------------
@@ -60,10 +116,11 @@ func LatencyStopHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if probe, exists := probes[request.Id]; exists {
-		probe.Stop()
+	if run, exists := probes.Remove(request.Id); exists {
+		probe := run.(*latencyProbe)
+		probe.Wait()
 		probe.flush()
-		delete(probes, request.Id)
+		probe.Close()
 		io.WriteString(w,
 			fmt.Sprintf("Latency probe with ID '%s' stopped and removed", request.Id))
 	} else {
@@ -84,9 +141,23 @@ func LatencyStatusHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	for _, probe := range probes {
-		io.WriteString(w,
-			fmt.Sprintf("Latency to %s : %d µs\n", probe.id, probe.latency.Nanoseconds()/1000))
+	for _, run := range probes.List() {
+		probe := run.(*latencyProbe)
+		io.WriteString(w, fmt.Sprintf("Latency to %s : %d µs over %s (%s)\n",
+			probe.id, probe.Latency().Nanoseconds()/1000, probe.Family(), probe.probeType))
+		if probe.probeType == ProbeHttp {
+			cold, warm := probe.ConnectionStats()
+			for _, stats := range []struct {
+				name string
+				httpConnectionStats
+			}{{"Cold", cold}, {"Warm", warm}} {
+				io.WriteString(w, fmt.Sprintf("  %s connections: %d µs, %d succeeded, %d failed\n",
+					stats.name, stats.Latency.Nanoseconds()/1000, stats.Succeeded, stats.Failed))
+			}
+		}
+		if summary := probe.EchoSummary(); summary != "" {
+			io.WriteString(w, fmt.Sprintf("  Echo requests: %s\n", summary))
+		}
 	}
 
 	// probe, exists := probes[request.Id]
@@ -115,11 +186,12 @@ func LatencySeriesHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	probe, exists := probes[request.Id]
+	run, exists := probes.Get(request.Id)
 	if !exists {
 		http.Error(w, fmt.Sprintf("No latency probe with ID '%s'", request.Id), 404)
 		return
 	}
+	probe := run.(*latencyProbe)
 
 	if file, err := os.Open(probe.logFilePath); err != nil {
 		http.Error(w, fmt.Sprintf("Error opening log file '%s': %s", probe.logFilePath, err), 500)
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckProbeType(t *testing.T) {
+	for _, test := range []struct {
+		probeType, target, expected string
+	}{
+		{"", "http://example.com/", ProbeHttp},
+		{ProbeTcpConnect, "example.com:443", ProbeTcpConnect},
+		{ProbeUdpEcho, "[::1]:5000", ProbeUdpEcho},
+		{ProbeIcmp, "example.com", ProbeIcmp},
+		{ProbeIcmp, "::1", ProbeIcmp},
+		// Errors:
+		{ProbeTcpConnect, "example.com", ""},
+		{ProbeUdpEcho, "", ""},
+		{ProbeIcmp, "example.com:443", ""},
+		{ProbeIcmp, "", ""},
+		{"dns", "example.com", ""},
+	} {
+		probeType, err := checkProbeType(test.probeType, test.target)
+		if probeType != test.expected || (err != nil) != (test.expected == "") {
+			t.Errorf("Expected type '%s' for %s probe to '%s' but got '%s' (error %v)",
+				test.expected, test.probeType, test.target, probeType, err)
+		}
+	}
+}
+
+func TestCheckHttpProbeStatusRange(t *testing.T) {
+	for _, test := range []struct {
+		statusMin, statusMax, expectedMin, expectedMax int
+	}{
+		{0, 0, 200, 399},
+		{204, 0, 204, 399},
+		{0, 299, 200, 299},
+		{400, 0, 400, 599},
+		{0, 199, 100, 199},
+		{100, 599, 100, 599},
+	} {
+		req := &LatencyNewRequest{Type: ProbeHttp, Target: "http://example.com/",
+			StatusMin: test.statusMin, StatusMax: test.statusMax}
+		if err := checkHttpProbe(req); err != nil {
+			t.Errorf("Unexpected error for status range [%d, %d]: %s",
+				test.statusMin, test.statusMax, err)
+		} else if req.StatusMin != test.expectedMin || req.StatusMax != test.expectedMax {
+			t.Errorf("Expected status range [%d, %d] for [%d, %d] but got [%d, %d]",
+				test.expectedMin, test.expectedMax, test.statusMin, test.statusMax,
+				req.StatusMin, req.StatusMax)
+		}
+		if req.Method != "GET" {
+			t.Errorf("Expected the GET method by default but got '%s'", req.Method)
+		}
+	}
+}
+
+func TestCheckHttpProbeErrors(t *testing.T) {
+	for _, req := range []*LatencyNewRequest{
+		{Type: ProbeHttp, Target: "http://example.com/", StatusMin: 99},
+		{Type: ProbeHttp, Target: "http://example.com/", StatusMax: 600},
+		{Type: ProbeHttp, Target: "http://example.com/", StatusMin: 300, StatusMax: 299},
+		{Type: ProbeHttp, Target: "http://example.com/", Method: "BAD METHOD"},
+		{Type: ProbeHttp, Target: "http://example.com/", BodyRegex: "("},
+		{Type: ProbeHttp, Target: "http://[::1/"},
+		// HTTP settings on other probe types:
+		{Type: ProbeTcpConnect, Target: "example.com:80", Method: "GET"},
+		{Type: ProbeIcmp, Target: "example.com", StatusMin: 200},
+	} {
+		if err := checkHttpProbe(req); err == nil {
+			t.Errorf("Expected an error for %+v", *req)
+		}
+	}
+	req := &LatencyNewRequest{Type: ProbeUdpEcho, Target: "example.com:5000"}
+	if err := checkHttpProbe(req); err != nil || req.Method != "" || req.StatusMin != 0 {
+		t.Errorf("Expected udp-echo probes to be left alone but got %+v (error %v)", *req, err)
+	}
+}
@@ -103,8 +103,12 @@ func TcpHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	run := NewTcpRun(request)
-	if err := WriteReply(w, req, run); err != nil {
+	run, err := NewTcpRun(request)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := WriteReply(w, req, run.Snapshot()); err != nil {
 		return
 	}
 	go run.Process()
@@ -116,9 +120,7 @@ func TcpStopHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if run, ok := tcpRuns[request.Id]; ok {
-		run.Stop()
-	} else {
+	if !tcpRuns.Stop(request.Id) {
 		http.Error(w, fmt.Sprintf("No TCP run with ID '%s'", request.Id), 404)
 	}
 }
@@ -129,21 +131,47 @@ func TcpStatusHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if run, ok := tcpRuns[request.Id]; ok {
-		WriteReply(w, req, run)
+	if run, ok := tcpRuns.Get(request.Id); ok {
+		WriteReply(w, req, run.(*TcpRun).Snapshot())
 	} else {
 		http.Error(w, fmt.Sprintf("No TCP run with ID '%s'", request.Id), 404)
 	}
 }
 
+func TcpReceiverListHandler(w http.ResponseWriter, req *http.Request) {
+	request := &TcpReceiverListReq{}
+	if err := ParseRequest(w, req, request); err != nil {
+		return
+	}
+
+	WriteReply(w, req, tcpReceivers.List(request.Active))
+}
+
+func TcpReceiverStatusHandler(w http.ResponseWriter, req *http.Request) {
+	request := &TcpReceiverStatusReq{}
+	if err := ParseRequest(w, req, request); err != nil {
+		return
+	}
+
+	if status, ok := tcpReceivers.Get(request.Id); ok {
+		WriteReply(w, req, status)
+	} else {
+		http.Error(w, fmt.Sprintf("No TCP receiver connection with ID '%s'", request.Id), 404)
+	}
+}
+
 func UdpHandler(w http.ResponseWriter, req *http.Request) {
 	request := &UdpReq{}
 	if err := ParseRequest(w, req, request); err != nil {
 		return
 	}
 
-	run := NewUdpRun(request)
-	if err := WriteReply(w, req, run); err != nil {
+	run, err := NewUdpRun(request)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := WriteReply(w, req, run.Snapshot()); err != nil {
 		return
 	}
 	go run.Process()
@@ -155,9 +183,7 @@ func UdpStopHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if run, ok := udpRuns[request.Id]; ok {
-		run.Stop()
-	} else {
+	if !udpRuns.Stop(request.Id) {
 		http.Error(w, fmt.Sprintf("No UDP run with ID '%s'", request.Id), 404)
 	}
 }
@@ -168,21 +194,47 @@ func UdpStatusHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if run, ok := udpRuns[request.Id]; ok {
-		WriteReply(w, req, run)
+	if run, ok := udpRuns.Get(request.Id); ok {
+		WriteReply(w, req, run.(*UdpRun).Snapshot())
 	} else {
 		http.Error(w, fmt.Sprintf("No UDP run with ID '%s'", request.Id), 404)
 	}
 }
 
+func UdpReceiverListHandler(w http.ResponseWriter, req *http.Request) {
+	request := &UdpReceiverListReq{}
+	if err := ParseRequest(w, req, request); err != nil {
+		return
+	}
+
+	WriteReply(w, req, udpFlows.List(request.RunId))
+}
+
+func UdpReceiverStatusHandler(w http.ResponseWriter, req *http.Request) {
+	request := &UdpReceiverStatusReq{}
+	if err := ParseRequest(w, req, request); err != nil {
+		return
+	}
+
+	if status, ok := udpFlows.Get(request.Id); ok {
+		WriteReply(w, req, status)
+	} else {
+		http.Error(w, fmt.Sprintf("No UDP flow with ID '%s'", request.Id), 404)
+	}
+}
+
 func startHttpService(port int) {
 	http.HandleFunc("/tcp/stop", TcpStopHandler)
 	http.HandleFunc("/tcp/status", TcpStatusHandler)
 	http.HandleFunc("/tcp", TcpHandler)
+	http.HandleFunc("/tcp/receiver/list", TcpReceiverListHandler)
+	http.HandleFunc("/tcp/receiver/status", TcpReceiverStatusHandler)
 
 	http.HandleFunc("/udp/stop", UdpStopHandler)
 	http.HandleFunc("/udp/status", UdpStatusHandler)
 	http.HandleFunc("/udp", UdpHandler)
+	http.HandleFunc("/udp/receiver/list", UdpReceiverListHandler)
+	http.HandleFunc("/udp/receiver/status", UdpReceiverStatusHandler)
 
 	address := fmt.Sprintf(":%d", port)
 	glog.Infof("Starting ping/pong service on %s\n", address)
@@ -7,3 +7,11 @@ func min(a, b uint64) uint64 {
 		return b
 	}
 }
+
+func max(a, b uint64) uint64 {
+	if a >= b {
+		return a
+	} else {
+		return b
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"time"
+)
+
+// Credit a pacer may accumulate while its writer is late, bounding the bursts that follow.
+const pacerMaxBurst = 2 * time.Millisecond
+
+// Waits shorter than this are spent spinning rather than sleeping, as timers are not precise
+// enough below a few hundred microseconds.
+const pacerSpinThreshold = 200 * time.Microsecond
+
+// Paces writes to a target bit rate and/or packet rate with a token bucket.
+//
+// The bucket is tracked as the time at which the next write is allowed: each write pushes it
+// back by the time the write takes at the target rate, and it may lag behind the current time
+// by at most pacerMaxBurst.
+type pacer struct {
+	// Target rates, 0 when not limited.
+	bitsPerSecond    float64
+	packetsPerSecond float64
+
+	next time.Time
+}
+
+// Returns nil if neither rate is limited.
+func newPacer(bitsPerSecond, packetsPerSecond uint64) *pacer {
+	if bitsPerSecond == 0 && packetsPerSecond == 0 {
+		return nil
+	}
+	return &pacer{
+		bitsPerSecond:    float64(bitsPerSecond),
+		packetsPerSecond: float64(packetsPerSecond),
+	}
+}
+
+// Time a write of nbytes takes at the target rates.
+func (p *pacer) cost(nbytes int) time.Duration {
+	var seconds float64
+	if p.bitsPerSecond > 0 {
+		seconds = float64(nbytes) * 8 / p.bitsPerSecond
+	}
+	if p.packetsPerSecond > 0 && 1/p.packetsPerSecond > seconds {
+		seconds = 1 / p.packetsPerSecond
+	}
+	return time.Duration(seconds * 1e9)
+}
+
+// Reserves a write of nbytes requested at time now, and returns the time it is allowed at.
+func (p *pacer) reserve(now time.Time, nbytes int) time.Time {
+	if p.next.Before(now.Add(-pacerMaxBurst)) {
+		p.next = now.Add(-pacerMaxBurst)
+	}
+	allowed := p.next
+	p.next = p.next.Add(p.cost(nbytes))
+	return allowed
+}
+
+// Waits until a write of nbytes is allowed. Returns false if ctx is done first.
+func (p *pacer) Wait(ctx context.Context, nbytes int) bool {
+	return p.waitUntil(ctx, p.reserve(time.Now(), nbytes))
+}
+
+// Whether waiting until the given time means sleeping, rather than spinning or not waiting.
+func (p *pacer) sleeps(allowed time.Time) bool {
+	return time.Until(allowed) > pacerSpinThreshold
+}
+
+// Waits until the time a write was allowed at by reserve. Returns false if ctx is done first.
+func (p *pacer) waitUntil(ctx context.Context, allowed time.Time) bool {
+	if wait := time.Until(allowed); wait > pacerSpinThreshold {
+		if !sleepContext(ctx, wait-pacerSpinThreshold) {
+			return false
+		}
+	}
+	for time.Now().Before(allowed) {
+		runtime.Gosched()
+	}
+	return ctx.Err() == nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPacerCost(t *testing.T) {
+	p := newPacer(8000000, 0)
+	if cost := p.cost(1000); cost != time.Millisecond {
+		t.Errorf("Expected 1000 bytes to take 1 ms at 8 Mb/s but got %s", cost)
+	}
+
+	// The lower rate applies:
+	p = newPacer(8000000, 100)
+	if cost := p.cost(1000); cost != 10*time.Millisecond {
+		t.Errorf("Expected 1 packet to take 10 ms at 100 packets/s but got %s", cost)
+	}
+
+	if p := newPacer(0, 0); p != nil {
+		t.Errorf("Expected no pacer without target rates")
+	}
+}
+
+func TestPacerReserve(t *testing.T) {
+	// 2000 writes requested at once, at 20000 packets per second:
+	p := newPacer(0, 20000)
+	start := time.Unix(1000, 0)
+	var allowed time.Time
+	for i := 0; i < 2000; i++ {
+		allowed = p.reserve(start, 100)
+	}
+	// The first write uses the burst credit, the others follow every 50 µs:
+	expected := start.Add(-pacerMaxBurst + 1999*50*time.Microsecond)
+	if !allowed.Equal(expected) {
+		t.Errorf("Expected the last write to be allowed at %s but got %s", expected, allowed)
+	}
+
+	// The credit accumulated while idle is bounded:
+	later := start.Add(time.Second)
+	if allowed := p.reserve(later, 100); !allowed.Equal(later.Add(-pacerMaxBurst)) {
+		t.Errorf("Expected a write after 1 s idle to be allowed at %s but got %s",
+			later.Add(-pacerMaxBurst), allowed)
+	}
+}
+
+func TestPacerWait(t *testing.T) {
+	// 2000 writes at 20000 packets per second cannot take less than about 100 ms:
+	p := newPacer(0, 20000)
+	start := time.Now()
+	for i := 0; i < 2000; i++ {
+		if !p.Wait(context.Background(), 100) {
+			t.Fatalf("Unexpected interruption of the pacer")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected pacing to take about 100ms but took %s", elapsed)
+	}
+}
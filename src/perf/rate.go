@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+)
+
+// rateMeter estimates the instantaneous rate of a byte stream over a fixed time window.
+type rateMeter struct {
+	// Width of the time window the rate is computed over.
+	window time.Duration
+
+	// Beginning of the current window, and number of bytes accounted in it so far.
+	windowStart time.Time
+	windowBytes uint64
+
+	// Rate measured over the last complete window, in bytes per second.
+	rate float64
+}
+
+func newRateMeter(window time.Duration) rateMeter {
+	return rateMeter{window: window}
+}
+
+// Accounts for nbytes transferred at time now.
+func (m *rateMeter) Add(now time.Time, nbytes uint64) {
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+	}
+	elapsed := now.Sub(m.windowStart)
+	if elapsed >= m.window {
+		m.rate = float64(m.windowBytes) * 1e9 / float64(elapsed.Nanoseconds())
+		m.windowStart = now
+		m.windowBytes = 0
+	}
+	m.windowBytes += nbytes
+}
+
+// Reports the rate in bytes per second, as observed at time now.
+// A stream that stayed idle for a whole window has a zero rate.
+func (m *rateMeter) Rate(now time.Time) float64 {
+	if m.windowStart.IsZero() || now.Sub(m.windowStart) >= 2*m.window {
+		return 0
+	}
+	return m.rate
+}
+
+// Average rate of nbytes transferred between two UNIX nanosecond timestamps, in bytes per second.
+func averageRate(nbytes uint64, startNs, endNs int64) float64 {
+	if endNs <= startNs {
+		return 0
+	}
+	return float64(nbytes) * 1e9 / float64(endNs-startNs)
+}
+
+// Jain's fairness index of the given allocations: (sum x)^2 / (n * sum x^2).
+// Ranges from 1/n to 1 (fair), and is 0 when nothing was allocated.
+func jainFairness(allocations []float64) float64 {
+	var sum, sumSquares float64
+	for _, x := range allocations {
+		sum += x
+		sumSquares += x * x
+	}
+	if sumSquares == 0 {
+		return 0
+	}
+	return sum * sum / (float64(len(allocations)) * sumSquares)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateMeter(t *testing.T) {
+	meter := newRateMeter(time.Second)
+	time0 := time.Unix(1000, 0)
+	if rate := meter.Rate(time0); rate != 0 {
+		t.Errorf("Expected no rate before any traffic but got %f", rate)
+	}
+
+	meter.Add(time0, 100)
+	meter.Add(time0.Add(500*time.Millisecond), 100)
+	meter.Add(time0.Add(time.Second), 100)
+	if rate := meter.Rate(time0.Add(time.Second)); rate != 200 {
+		t.Errorf("Expected rate of 200 B/s but got %f", rate)
+	}
+
+	// Idle for more than a window:
+	if rate := meter.Rate(time0.Add(3 * time.Second)); rate != 0 {
+		t.Errorf("Expected no rate after idling but got %f", rate)
+	}
+}
+
+func TestJainFairness(t *testing.T) {
+	if f := jainFairness([]float64{10, 10, 10, 10}); f != 1 {
+		t.Errorf("Expected fairness of 1 but got %f", f)
+	}
+	if f := jainFairness([]float64{10, 0, 0, 0}); f != 0.25 {
+		t.Errorf("Expected fairness of 0.25 but got %f", f)
+	}
+	if f := jainFairness([]float64{0, 0}); f != 0 {
+		t.Errorf("Expected fairness of 0 without traffic but got %f", f)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Owns a set of runs (TCP or UDP traffic runs, latency probes), indexed by ID.
+//
+// Each run gets a context, cancelled when the run is stopped or removed. Runs remain
+// available for status requests after they are stopped, until they are removed.
+type runManager struct {
+	mutex sync.Mutex
+	runs  map[string]*managedRun
+}
+
+type managedRun struct {
+	run    interface{}
+	cancel context.CancelFunc
+}
+
+func newRunManager() *runManager {
+	return &runManager{runs: make(map[string]*managedRun)}
+}
+
+// Registers a run, and returns the context that governs its lifetime.
+// Returns false if a run with the same ID already exists.
+func (m *runManager) Add(id string, run interface{}) (context.Context, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.runs[id]; exists {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.runs[id] = &managedRun{run, cancel}
+	return ctx, true
+}
+
+func (m *runManager) Get(id string) (interface{}, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if managed, ok := m.runs[id]; ok {
+		return managed.run, true
+	}
+	return nil, false
+}
+
+// Cancels the context of a run. Returns false if there is no run with this ID.
+func (m *runManager) Stop(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if managed, ok := m.runs[id]; ok {
+		managed.cancel()
+		return true
+	}
+	return false
+}
+
+// Cancels the context of a run and forgets about it.
+func (m *runManager) Remove(id string) (interface{}, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if managed, ok := m.runs[id]; ok {
+		managed.cancel()
+		delete(m.runs, id)
+		return managed.run, true
+	}
+	return nil, false
+}
+
+// Lists the runs, ordered by ID.
+func (m *runManager) List() []interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ids := make([]string, 0, len(m.runs))
+	for id := range m.runs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	runs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		runs[i] = m.runs[id].run
+	}
+	return runs
+}
+
+// -------------------------------------------------------------------------------------------------
+
+// Interrupts the blocked and future reads and writes on a connection once ctx is done.
+// The returned function detaches the connection from the context.
+func interruptOnCancel(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// Sleeps for the given duration, unless ctx is done first.
+// Returns false if ctx is done.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	if duration <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Derives the context bounding the traffic of a run with an optional end time.
+func withEndTime(ctx context.Context, hasEndTime bool, endTime time.Time) (
+	context.Context, context.CancelFunc) {
+
+	if hasEndTime {
+		return context.WithDeadline(ctx, endTime)
+	}
+	return context.WithCancel(ctx)
+}
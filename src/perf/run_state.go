@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// States of a traffic run.
+const (
+	// The run was created but did not start processing yet.
+	RunPending = "pending"
+
+	// Connections are established, the run waits for its start time.
+	RunWaitingForStart = "waiting-for-start"
+
+	RunRunning = "running"
+
+	// The traffic completed: max bytes reached, end time reached or remote done sending.
+	RunCompleted = "completed"
+
+	// The run was stopped through a stop request.
+	RunStopped = "stopped"
+
+	// The run was interrupted by an error, described by the failure reason.
+	RunFailed = "failed"
+)
+
+// Reasons for the failure of a traffic run.
+const (
+	FailureDns        = "dns"
+	FailureRefused    = "refused"
+	FailureTimeout    = "timeout"
+	FailureReset      = "reset"
+	FailureConnect    = "connect-error"
+	FailureSockopt    = "socket-option"
+	FailureWriteError = "write-error"
+	FailureReadError  = "read-error"
+)
+
+type RunStateTransition struct {
+	State string `json:state`
+
+	// In UNIX nanoseconds
+	Time int64 `json:time`
+}
+
+// Lifecycle of a traffic run, embedded in the run status.
+type RunLifecycle struct {
+	State string `json:state`
+
+	// Empty unless the run failed.
+	FailureReason string `json:failureReason`
+	Error         string `json:error`
+
+	// States the run went through, oldest first.
+	Transitions []RunStateTransition `json:transitions`
+}
+
+func newRunLifecycle() RunLifecycle {
+	l := RunLifecycle{}
+	l.transition(RunPending)
+	return l
+}
+
+func (l *RunLifecycle) isFinal() bool {
+	return l.State == RunCompleted || l.State == RunStopped || l.State == RunFailed
+}
+
+// Moves to a new state, unless the run already reached a final state.
+func (l *RunLifecycle) transition(state string) {
+	if l.isFinal() || l.State == state {
+		return
+	}
+	l.State = state
+	l.Transitions = append(l.Transitions, RunStateTransition{state, time.Now().UnixNano()})
+}
+
+// Records the first error that interrupted the run.
+func (l *RunLifecycle) fail(reason string, err error) {
+	if l.FailureReason == "" {
+		l.FailureReason = reason
+		l.Error = err.Error()
+	}
+}
+
+// Moves to the final state once the run is over: failed if an error was recorded,
+// stopped if the run context was cancelled, and completed otherwise.
+func (l *RunLifecycle) finish(runCtx context.Context) {
+	switch {
+	case l.FailureReason != "":
+		l.transition(RunFailed)
+	case runCtx.Err() != nil:
+		l.transition(RunStopped)
+	default:
+		l.transition(RunCompleted)
+	}
+}
+
+func (l *RunLifecycle) copy() RunLifecycle {
+	c := *l
+	c.Transitions = append([]RunStateTransition(nil), l.Transitions...)
+	return c
+}
+
+// Classifies an error, falling back to the given reason for unidentified errors.
+func failureReason(err error, fallback string) string {
+	var dnsErr *net.DNSError
+	var addrErr *net.AddrError
+	if errors.As(err, &dnsErr) || errors.As(err, &addrErr) {
+		return FailureDns
+	}
+	var sockoptErr *socketOptionError
+	if errors.As(err, &sockoptErr) {
+		return FailureSockopt
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return FailureRefused
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return FailureTimeout
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return FailureReset
+	}
+	return fallback
+}
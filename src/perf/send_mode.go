@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// How a TCP traffic run hands the data it sends to the kernel.
+const (
+	// Writes from a buffer, which the kernel copies.
+	SendModeCopy = "copy"
+
+	// Sends a file from the data directory with sendfile, without copying it to user space.
+	SendModeSendfile = "sendfile"
+
+	// Writes from a buffer with MSG_ZEROCOPY: the kernel pins the pages of the buffer instead
+	// of copying them.
+	SendModeZerocopy = "zerocopy"
+)
+
+// Validates the send mode of a TCP run and its file, and applies the default (copy).
+func checkSendMode(mode string, file string) (string, error) {
+	switch mode {
+	case "":
+		mode = SendModeCopy
+	case SendModeCopy, SendModeZerocopy:
+	case SendModeSendfile:
+		if file == "" || filepath.Base(file) != file {
+			return "", fmt.Errorf("Invalid send file '%s', must name a file in the data directory",
+				file)
+		}
+		info, err := os.Stat(sendFilePath(file))
+		if err != nil {
+			return "", err
+		}
+		if !info.Mode().IsRegular() || info.Size() == 0 {
+			return "", fmt.Errorf("Invalid send file '%s', must be a non-empty regular file", file)
+		}
+	default:
+		return "", fmt.Errorf("Invalid send mode '%s'", mode)
+	}
+	if mode != SendModeSendfile && file != "" {
+		return "", fmt.Errorf("A send file only applies to the %s send mode", SendModeSendfile)
+	}
+	return mode, nil
+}
+
+func sendFilePath(file string) string {
+	return path.Join(*flagDataDir, file)
+}
+
+// Sends a file over a connection with sendfile, over and over, as many bytes as the buffer
+// passed to every write.
+type sendfileWriter struct {
+	conn *net.TCPConn
+	file *os.File
+	size int64
+
+	// Position of the next write in the file.
+	offset int64
+}
+
+func newSendfileWriter(conn *net.TCPConn, file string) (*sendfileWriter, error) {
+	f, err := os.Open(sendFilePath(file))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sendfileWriter{conn: conn, file: f, size: info.Size()}, nil
+}
+
+func (w *sendfileWriter) Write(buffer []byte) (int, error) {
+	if w.offset == w.size {
+		if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		w.offset = 0
+	}
+	nbytes, err := w.conn.ReadFrom(&io.LimitedReader{R: w.file, N: int64(len(buffer))})
+	w.offset += nbytes
+	return int(nbytes), err
+}
+
+func (w *sendfileWriter) Close() error {
+	return w.file.Close()
+}
+
+// CPU time used by the agent process, in nanoseconds.
+type cpuUsage struct {
+	user   int64
+	system int64
+}
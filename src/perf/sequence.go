@@ -0,0 +1,108 @@
+package main
+
+// Number of sequence numbers, below the highest received, within which a packet arriving
+// out of order can be told apart from a duplicate.
+const seqWindowSize = 4096
+
+// Tracks the sequence numbers of the packets received in a flow.
+// Sequence numbers are expected to start at 0 and to increase by 1 for each packet sent.
+type seqTracker struct {
+	// Next sequence number expected, ie. highest sequence number received + 1.
+	next uint64
+
+	// Bitmap of the sequence numbers received in [next - seqWindowSize, next).
+	window [seqWindowSize / 64]uint64
+
+	// Total number of packets received, including duplicates and late packets.
+	Received uint64
+
+	// Number of packets that never arrived, or that arrived too late to be told apart.
+	Lost uint64
+
+	// Number of packets received after a packet with a higher sequence number.
+	Reordered uint64
+
+	// Number of packets received more than once.
+	Duplicates uint64
+
+	// Number of packets received after falling out of the reordering window.
+	// These packets remain accounted as lost.
+	Late uint64
+}
+
+func (t *seqTracker) isSet(seq uint64) bool {
+	bit := seq % seqWindowSize
+	return t.window[bit/64]&(1<<(bit%64)) != 0
+}
+
+func (t *seqTracker) set(seq uint64) {
+	bit := seq % seqWindowSize
+	t.window[bit/64] |= 1 << (bit % 64)
+}
+
+func (t *seqTracker) clear(seq uint64) {
+	bit := seq % seqWindowSize
+	t.window[bit/64] &^= 1 << (bit % 64)
+}
+
+// Accounts for a packet received with the given sequence number.
+func (t *seqTracker) Add(seq uint64) {
+	t.Received += 1
+	switch {
+	case seq >= t.next:
+		t.skipTo(seq)
+		t.set(seq)
+		t.next = seq + 1
+
+	case t.next-seq > seqWindowSize:
+		t.Late += 1
+
+	case t.isSet(seq):
+		t.Duplicates += 1
+
+	default:
+		// Counted as lost when skipped:
+		t.set(seq)
+		t.Reordered += 1
+		if t.Lost > 0 {
+			t.Lost -= 1
+		}
+	}
+}
+
+// Accounts for the packets from the next sequence number expected up to seq, excluded, as
+// lost until received.
+func (t *seqTracker) skipTo(seq uint64) {
+	gap := seq - t.next
+	t.Lost += gap
+	if gap >= seqWindowSize {
+		t.window = [seqWindowSize / 64]uint64{}
+	} else {
+		for s := t.next; s < seq; s++ {
+			t.clear(s)
+		}
+	}
+}
+
+// Accounts for the end of a flow, after total packets were sent.
+// Lost packets with the highest sequence numbers can only be detected this way. Packets
+// received afterwards remain accounted for as reordered, duplicated or late.
+func (t *seqTracker) Finish(total uint64) {
+	if total > t.next {
+		t.skipTo(total)
+		t.next = total
+	}
+}
+
+// Number of packets expected so far, based on the highest sequence number received.
+func (t *seqTracker) Expected() uint64 {
+	return t.next
+}
+
+// Percentage of the expected packets that were lost.
+func (t *seqTracker) LossPercent() float64 {
+	if t.next == 0 {
+		return 0
+	}
+	return 100 * float64(t.Lost) / float64(t.next)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func checkTracker(t *testing.T, tracker *seqTracker, received, lost, reordered, duplicates, late uint64) {
+	actual := []uint64{
+		tracker.Received, tracker.Lost, tracker.Reordered, tracker.Duplicates, tracker.Late}
+	expected := []uint64{received, lost, reordered, duplicates, late}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected received/lost/reordered/duplicates/late to be %v but got %v",
+				expected, actual)
+			return
+		}
+	}
+}
+
+func TestSeqTrackerInOrder(t *testing.T) {
+	tracker := &seqTracker{}
+	for seq := uint64(0); seq < 10; seq++ {
+		tracker.Add(seq)
+	}
+	checkTracker(t, tracker, 10, 0, 0, 0, 0)
+	if tracker.Expected() != 10 || tracker.LossPercent() != 0 {
+		t.Errorf("Unexpected expected count %d or loss %f",
+			tracker.Expected(), tracker.LossPercent())
+	}
+}
+
+func TestSeqTrackerLoss(t *testing.T) {
+	tracker := &seqTracker{}
+	tracker.Add(1)
+	checkTracker(t, tracker, 1, 1, 0, 0, 0)
+
+	tracker.Add(5)
+	checkTracker(t, tracker, 2, 4, 0, 0, 0)
+
+	if tracker.LossPercent() != 100*4.0/6.0 {
+		t.Errorf("Expected loss of %f%% but got %f%%", 100*4.0/6.0, tracker.LossPercent())
+	}
+}
+
+func TestSeqTrackerReorderAndDuplicates(t *testing.T) {
+	tracker := &seqTracker{}
+	tracker.Add(0)
+	tracker.Add(2)
+	checkTracker(t, tracker, 2, 1, 0, 0, 0)
+
+	tracker.Add(1)
+	checkTracker(t, tracker, 3, 0, 1, 0, 0)
+
+	tracker.Add(1)
+	checkTracker(t, tracker, 4, 0, 1, 1, 0)
+
+	tracker.Add(2)
+	checkTracker(t, tracker, 5, 0, 1, 2, 0)
+}
+
+func TestSeqTrackerLate(t *testing.T) {
+	tracker := &seqTracker{}
+	tracker.Add(seqWindowSize + 10)
+	checkTracker(t, tracker, 1, seqWindowSize+10, 0, 0, 0)
+
+	// Within the window, but never received before:
+	tracker.Add(20)
+	checkTracker(t, tracker, 2, seqWindowSize+9, 1, 0, 0)
+
+	// Out of the window:
+	tracker.Add(5)
+	checkTracker(t, tracker, 3, seqWindowSize+9, 1, 0, 1)
+}
+
+func TestSeqTrackerFinish(t *testing.T) {
+	tracker := &seqTracker{}
+	tracker.Add(0)
+	tracker.Add(1)
+	tracker.Finish(2)
+	checkTracker(t, tracker, 2, 0, 0, 0, 0)
+
+	tracker.Finish(5)
+	checkTracker(t, tracker, 2, 3, 0, 0, 0)
+	if tracker.Expected() != 5 {
+		t.Errorf("Expected 5 packets but got %d", tracker.Expected())
+	}
+}
+
+func TestSeqTrackerAfterFinish(t *testing.T) {
+	tracker := &seqTracker{}
+	tracker.Add(0)
+	tracker.Add(1)
+	tracker.Finish(4)
+	checkTracker(t, tracker, 2, 2, 0, 0, 0)
+
+	// A duplicate of a packet received before the end:
+	tracker.Add(1)
+	checkTracker(t, tracker, 3, 2, 0, 1, 0)
+
+	// A packet counted as lost at the end, and its duplicate:
+	tracker.Add(3)
+	tracker.Add(3)
+	checkTracker(t, tracker, 5, 1, 1, 2, 0)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Reported when setting a socket option that is not supported on this platform.
+var errSocketOptionUnsupported = errors.New("not supported on this platform")
+
+// Socket options of the sockets of a run or of a sink. Options left unset keep the system
+// defaults.
+type SocketOptions struct {
+	// SO_SNDBUF and SO_RCVBUF, in bytes. The kernel doubles and caps the values.
+	SendBuffer    int `json:sendBuffer`
+	ReceiveBuffer int `json:receiveBuffer`
+
+	// TCP only: TCP_NODELAY (enabled by default) and TCP_CORK.
+	NoDelay *bool `json:noDelay`
+	Cork    bool  `json:cork`
+
+	// TCP only: TCP_MAXSEG, in bytes.
+	MaxSegment int `json:maxSegment`
+
+	// TCP only: keepalive idle time and probe interval, in seconds. Negative to disable.
+	KeepAliveSec int `json:keepAliveSec`
+
+	// TCP only: SO_LINGER timeout, in seconds. 0 resets connections when closed.
+	LingerSec *int `json:lingerSec`
+
+	// TCP only: TCP_NOTSENT_LOWAT, in bytes.
+	NotsentLowat int `json:notsentLowat`
+
+	// SO_MAX_PACING_RATE, in bytes per second.
+	MaxPacingRate uint64 `json:maxPacingRate`
+}
+
+// Values of the socket options in effect on a socket, as read back from the kernel.
+type SocketOptionValues struct {
+	SendBuffer    int `json:sendBuffer`
+	ReceiveBuffer int `json:receiveBuffer`
+
+	// In bytes per second, all bits set when unlimited.
+	MaxPacingRate uint64 `json:maxPacingRate`
+
+	// TCP only
+	NoDelay          bool `json:noDelay`
+	Cork             bool `json:cork`
+	MaxSegment       int  `json:maxSegment`
+	KeepAlive        bool `json:keepAlive`
+	KeepAliveIdleSec int  `json:keepAliveIdleSec`
+	LingerSec        int  `json:lingerSec` // -1 when disabled
+	NotsentLowat     int  `json:notsentLowat`
+}
+
+// Validates a DSCP value, 0 leaving the traffic unmarked.
+func checkDscp(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("Invalid DSCP value %d, must be within [0, 63]", dscp)
+	}
+	return nil
+}
+
+// Whether the network of a socket, as passed to dialer and listener controls, is IPv6.
+func isIPv6Network(network string) bool {
+	return strings.HasSuffix(network, "6")
+}
+
+// Parses socket options from a JSON flag value.
+func parseSocketOptions(flagValue string) (*SocketOptions, error) {
+	opts := &SocketOptions{}
+	if flagValue == "" {
+		return opts, nil
+	}
+	if err := json.Unmarshal([]byte(flagValue), opts); err != nil {
+		return nil, fmt.Errorf("Invalid socket options '%s': %s", flagValue, err)
+	}
+	return opts, nil
+}
+
+// Rejects the TCP options in socket options meant for UDP sockets.
+func (o *SocketOptions) checkUdp() error {
+	if o.NoDelay != nil || o.Cork || o.MaxSegment != 0 || o.KeepAliveSec != 0 ||
+		o.LingerSec != nil || o.NotsentLowat != 0 {
+		return errors.New("Invalid socket options: only buffers and pacing rate apply to UDP")
+	}
+	return nil
+}
+
+// Applies the options that must be set on a TCP socket once connected.
+func (o *SocketOptions) applyTcpConn(conn *net.TCPConn) error {
+	if o.NoDelay != nil {
+		if err := conn.SetNoDelay(*o.NoDelay); err != nil {
+			return &socketOptionError{"TCP_NODELAY", err}
+		}
+	}
+	if o.KeepAliveSec != 0 {
+		if err := conn.SetKeepAlive(o.KeepAliveSec > 0); err != nil {
+			return &socketOptionError{"SO_KEEPALIVE", err}
+		}
+		if o.KeepAliveSec > 0 {
+			period := time.Duration(o.KeepAliveSec) * time.Second
+			if err := conn.SetKeepAlivePeriod(period); err != nil {
+				return &socketOptionError{"TCP_KEEPIDLE", err}
+			}
+		}
+	}
+	if o.LingerSec != nil {
+		if err := conn.SetLinger(*o.LingerSec); err != nil {
+			return &socketOptionError{"SO_LINGER", err}
+		}
+	}
+	return nil
+}
+
+// Reads the socket options in effect on a connection. Returns nil if not available, and logs why.
+func readSocketOptions(conn syscall.Conn, tcp bool) *SocketOptionValues {
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		var values *SocketOptionValues
+		if values, err = getSocketOptions(rawConn, tcp); err == nil {
+			return values
+		}
+	}
+	if err != errSocketOptionUnsupported {
+		glog.V(1).Infof("Error reading socket options: %s", err)
+	}
+	return nil
+}
+
+// Error setting a socket option requested by a run.
+type socketOptionError struct {
+	option string
+	err    error
+}
+
+func (e *socketOptionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.option, e.err)
+}
+
+func (e *socketOptionError) Unwrap() error {
+	return e.err
+}
+
+// Runs fn on the file descriptor of a socket.
+func controlFd(rawConn syscall.RawConn, fn func(fd int) error) error {
+	var fnErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// Reads the congestion control algorithm in effect on a connection. Returns an empty string if
+// not available, and logs why.
+func readCongestionControl(conn *net.TCPConn) string {
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		var name string
+		if name, err = getCongestionControl(rawConn); err == nil {
+			return name
+		}
+	}
+	if err != errSocketOptionUnsupported {
+		glog.V(1).Infof("Error reading TCP_CONGESTION of connection to %s: %s",
+			conn.RemoteAddr(), err)
+	}
+	return ""
+}
+
+// Reads the DSCP value of the packets received last on a TCP connection. Returns -1 if not
+// available, and logs why.
+func readReceivedDscp(conn *net.TCPConn) int {
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		var dscp int
+		ipv6 := addressFamily(conn.RemoteAddr()) == AddressFamilyIPv6
+		if dscp, err = getReceivedDscp(rawConn, ipv6); err == nil {
+			return dscp
+		}
+	}
+	if err != errSocketOptionUnsupported {
+		glog.V(1).Infof("Error reading DSCP of connection from %s: %s", conn.RemoteAddr(), err)
+	}
+	return -1
+}
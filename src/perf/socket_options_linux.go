@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets the congestion control algorithm of a TCP socket (TCP_CONGESTION).
+func setCongestionControl(rawConn syscall.RawConn, name string) error {
+	err := controlFd(rawConn, func(fd int) error {
+		return unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, name)
+	})
+	if err != nil {
+		return &socketOptionError{"TCP_CONGESTION=" + name, err}
+	}
+	return nil
+}
+
+// Reads the congestion control algorithm in effect on a TCP socket.
+func getCongestionControl(rawConn syscall.RawConn) (name string, err error) {
+	err = controlFd(rawConn, func(fd int) (err error) {
+		name, err = unix.GetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+		return
+	})
+	return
+}
+
+// Applies the options that must be set on a socket before it connects or listens.
+func setSocketOptions(rawConn syscall.RawConn, opts *SocketOptions) error {
+	var option string
+	err := controlFd(rawConn, func(fd int) error {
+		set := func(name string, level, opt, value int) error {
+			option = name
+			return unix.SetsockoptInt(fd, level, opt, value)
+		}
+		if opts.SendBuffer > 0 {
+			if err := set("SO_SNDBUF", unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SendBuffer); err != nil {
+				return err
+			}
+		}
+		if opts.ReceiveBuffer > 0 {
+			err := set("SO_RCVBUF", unix.SOL_SOCKET, unix.SO_RCVBUF, opts.ReceiveBuffer)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.Cork {
+			if err := set("TCP_CORK", unix.IPPROTO_TCP, unix.TCP_CORK, 1); err != nil {
+				return err
+			}
+		}
+		if opts.MaxSegment > 0 {
+			err := set("TCP_MAXSEG", unix.IPPROTO_TCP, unix.TCP_MAXSEG, opts.MaxSegment)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.NotsentLowat > 0 {
+			err := set("TCP_NOTSENT_LOWAT", unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT,
+				opts.NotsentLowat)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.MaxPacingRate > 0 {
+			option = "SO_MAX_PACING_RATE"
+			return unix.SetsockoptUint64(
+				fd, unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE, opts.MaxPacingRate)
+		}
+		return nil
+	})
+	if err != nil {
+		return &socketOptionError{option, err}
+	}
+	return nil
+}
+
+// Reads back the socket options in effect on a socket.
+func getSocketOptions(rawConn syscall.RawConn, tcp bool) (*SocketOptionValues, error) {
+	values := &SocketOptionValues{}
+	err := controlFd(rawConn, func(fd int) (err error) {
+		get := func(level, opt int, value *int) {
+			if err == nil {
+				*value, err = unix.GetsockoptInt(fd, level, opt)
+			}
+		}
+		get(unix.SOL_SOCKET, unix.SO_SNDBUF, &values.SendBuffer)
+		get(unix.SOL_SOCKET, unix.SO_RCVBUF, &values.ReceiveBuffer)
+		if err == nil {
+			values.MaxPacingRate, err =
+				unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE)
+		}
+		if !tcp {
+			return
+		}
+
+		var noDelay, cork, keepAlive int
+		get(unix.IPPROTO_TCP, unix.TCP_NODELAY, &noDelay)
+		get(unix.IPPROTO_TCP, unix.TCP_CORK, &cork)
+		get(unix.IPPROTO_TCP, unix.TCP_MAXSEG, &values.MaxSegment)
+		get(unix.SOL_SOCKET, unix.SO_KEEPALIVE, &keepAlive)
+		get(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, &values.KeepAliveIdleSec)
+		get(unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, &values.NotsentLowat)
+		values.NoDelay = noDelay != 0
+		values.Cork = cork != 0
+		values.KeepAlive = keepAlive != 0
+		if err == nil {
+			var linger *unix.Linger
+			if linger, err = unix.GetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER); err == nil {
+				values.LingerSec = -1
+				if linger.Onoff != 0 {
+					values.LingerSec = int(linger.Linger)
+				}
+			}
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Space for the control messages carrying the TOS byte of a received packet.
+var dscpControlSize = unix.CmsgSpace(4)
+
+// Marks the traffic of a socket with a DSCP value: IP_TOS, or IPV6_TCLASS for IPv6 sockets.
+// The ECN bits are left clear.
+func setDscp(rawConn syscall.RawConn, network string, dscp int) error {
+	level, opt, option := unix.IPPROTO_IP, unix.IP_TOS, "IP_TOS"
+	if isIPv6Network(network) {
+		level, opt, option = unix.IPPROTO_IPV6, unix.IPV6_TCLASS, "IPV6_TCLASS"
+	}
+	err := controlFd(rawConn, func(fd int) error {
+		return unix.SetsockoptInt(fd, level, opt, dscp<<2)
+	})
+	if err != nil {
+		return &socketOptionError{option, err}
+	}
+	return nil
+}
+
+// Enables the reception of the TOS byte of incoming packets: IP_RECVTOS, and IPV6_RECVTCLASS as
+// well for IPv6 sockets, which also receive IPv4 packets when dual-stack.
+func enableRecvTos(rawConn syscall.RawConn, network string) error {
+	option := "IP_RECVTOS"
+	err := controlFd(rawConn, func(fd int) error {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1); err != nil {
+			return err
+		}
+		if isIPv6Network(network) {
+			option = "IPV6_RECVTCLASS"
+			return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+		}
+		return nil
+	})
+	if err != nil {
+		return &socketOptionError{option, err}
+	}
+	return nil
+}
+
+// Extracts the DSCP value from the control messages of a received packet. Returns -1 if absent.
+func parseDscp(oob []byte) int {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+	for _, message := range messages {
+		if dscp, ok := messageDscp(&message); ok {
+			return dscp
+		}
+	}
+	return -1
+}
+
+func messageDscp(message *unix.SocketControlMessage) (int, bool) {
+	level, kind := message.Header.Level, message.Header.Type
+	if (level == unix.IPPROTO_IP && kind == unix.IP_TOS) ||
+		(level == unix.IPPROTO_IPV6 && kind == unix.IPV6_TCLASS) {
+		// A byte for received IPv4 packets, an int otherwise:
+		switch len(message.Data) {
+		case 1:
+			return int(message.Data[0]) >> 2, true
+		case 4:
+			return int(binary.NativeEndian.Uint32(message.Data)&0xff) >> 2, true
+		}
+	}
+	return 0, false
+}
+
+// Reads the DSCP value of the packets received last on a TCP socket with IP_RECVTOS enabled,
+// through IP_PKTOPTIONS, or IPV6_2292PKTOPTIONS for IPv6 peers. Returns -1 if unknown.
+func getReceivedDscp(rawConn syscall.RawConn, ipv6 bool) (int, error) {
+	level, opt := unix.IPPROTO_IP, unix.IP_PKTOPTIONS
+	if ipv6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_2292PKTOPTIONS
+	}
+	dscp := -1
+	err := controlFd(rawConn, func(fd int) error {
+		oob := make([]byte, dscpControlSize)
+		size := uint32(len(oob))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+			uintptr(unsafe.Pointer(&oob[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			return errno
+		}
+		dscp = parseDscp(oob[:size])
+		return nil
+	})
+	return dscp, err
+}
+
+// Restricts a socket to a network interface (SO_BINDTODEVICE).
+func bindToDevice(rawConn syscall.RawConn, iface string) error {
+	err := controlFd(rawConn, func(fd int) error {
+		return unix.BindToDevice(fd, iface)
+	})
+	if err != nil {
+		return &socketOptionError{"SO_BINDTODEVICE=" + iface, err}
+	}
+	return nil
+}
+
+// Lets several sockets bind the same port, the kernel spreading the incoming flows among them.
+func setReusePort(rawConn syscall.RawConn) error {
+	err := controlFd(rawConn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return &socketOptionError{"SO_REUSEPORT", err}
+	}
+	return nil
+}
+
+// Whether batches of datagrams can be sent with one system call.
+const udpSendmmsgSupported = true
+
+// Sets the size of the datagrams the kernel splits the writes to a UDP socket into, 0 to disable
+// segmentation.
+func setUdpSegment(conn *net.UDPConn, size int) error {
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		err = controlFd(rawConn, func(fd int) error {
+			return unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_SEGMENT, size)
+		})
+	}
+	if err != nil {
+		return &socketOptionError{fmt.Sprintf("UDP_SEGMENT=%d", size), err}
+	}
+	return nil
+}
+
+// Room for the drop counter of SO_RXQ_OVFL in the control messages of a received packet.
+var rxqOvflControlSize = unix.CmsgSpace(4)
+
+// Enables SO_RXQ_OVFL: received packets carry the number of packets the socket dropped so far
+// because its receive buffer was full.
+func enableRxqOvfl(rawConn syscall.RawConn) error {
+	err := controlFd(rawConn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+	})
+	if err != nil {
+		return &socketOptionError{"SO_RXQ_OVFL", err}
+	}
+	return nil
+}
+
+// Extracts what the control messages of a received datagram tell about it: its DSCP value and
+// kernel timestamp, and the drop counter of SO_RXQ_OVFL, which the kernel leaves out until the
+// first drop.
+func parseUdpControl(oob []byte, info *udpPacketInfo) (dropCounter uint32) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, message := range messages {
+		if dscp, ok := messageDscp(&message); ok {
+			info.dscp = dscp
+			continue
+		}
+		if message.Header.Level != unix.SOL_SOCKET {
+			continue
+		}
+		switch message.Header.Type {
+		case unix.SO_RXQ_OVFL:
+			if len(message.Data) == 4 {
+				dropCounter = binary.NativeEndian.Uint32(message.Data)
+			}
+		case unix.SO_TIMESTAMPING:
+			if timestamp, source := parseTimestamping(message.Data); timestamp != 0 {
+				info.time, info.timeSource = timestamp, source
+			}
+		}
+	}
+	return dropCounter
+}
@@ -0,0 +1,73 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+func setCongestionControl(rawConn syscall.RawConn, name string) error {
+	return &socketOptionError{"TCP_CONGESTION=" + name, errSocketOptionUnsupported}
+}
+
+func getCongestionControl(rawConn syscall.RawConn) (string, error) {
+	return "", errSocketOptionUnsupported
+}
+
+func setSocketOptions(rawConn syscall.RawConn, opts *SocketOptions) error {
+	if opts.SendBuffer > 0 || opts.ReceiveBuffer > 0 || opts.Cork || opts.MaxSegment > 0 ||
+		opts.NotsentLowat > 0 || opts.MaxPacingRate > 0 {
+		return &socketOptionError{"socket options", errSocketOptionUnsupported}
+	}
+	return nil
+}
+
+func getSocketOptions(rawConn syscall.RawConn, tcp bool) (*SocketOptionValues, error) {
+	return nil, errSocketOptionUnsupported
+}
+
+var dscpControlSize = 0
+
+func setDscp(rawConn syscall.RawConn, network string, dscp int) error {
+	return &socketOptionError{"IP_TOS", errSocketOptionUnsupported}
+}
+
+func enableRecvTos(rawConn syscall.RawConn, network string) error {
+	return &socketOptionError{"IP_RECVTOS", errSocketOptionUnsupported}
+}
+
+func parseDscp(oob []byte) int {
+	return -1
+}
+
+func getReceivedDscp(rawConn syscall.RawConn, ipv6 bool) (int, error) {
+	return -1, errSocketOptionUnsupported
+}
+
+func bindToDevice(rawConn syscall.RawConn, iface string) error {
+	return &socketOptionError{"SO_BINDTODEVICE=" + iface, errSocketOptionUnsupported}
+}
+
+// Other platforms do not spread the incoming flows among the sockets sharing a port.
+func setReusePort(rawConn syscall.RawConn) error {
+	return &socketOptionError{"SO_REUSEPORT", errSocketOptionUnsupported}
+}
+
+// Whether batches of datagrams can be sent with one system call.
+const udpSendmmsgSupported = false
+
+func setUdpSegment(conn *net.UDPConn, size int) error {
+	return &socketOptionError{fmt.Sprintf("UDP_SEGMENT=%d", size), errSocketOptionUnsupported}
+}
+
+var rxqOvflControlSize = 0
+
+func enableRxqOvfl(rawConn syscall.RawConn) error {
+	return &socketOptionError{"SO_RXQ_OVFL", errSocketOptionUnsupported}
+}
+
+func parseUdpControl(oob []byte, info *udpPacketInfo) (dropCounter uint32) {
+	return 0
+}
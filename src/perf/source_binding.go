@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Validates the source address and port a run or probe binds its sockets to.
+func checkSource(sourceAddress string, sourcePort int) error {
+	if sourceAddress != "" && net.ParseIP(sourceAddress) == nil {
+		return fmt.Errorf("Invalid source address '%s', must be an IP address", sourceAddress)
+	}
+	if sourcePort < 0 || sourcePort > 65535 {
+		return fmt.Errorf("Invalid source port %d", sourcePort)
+	}
+	return nil
+}
+
+// Local address to bind the sockets of a run or probe to, for the "tcp" or "udp" network.
+// Returns nil to let the system pick the address and port.
+func sourceAddr(network, sourceAddress string, sourcePort int) net.Addr {
+	if sourceAddress == "" && sourcePort == 0 {
+		return nil
+	}
+	ip := net.ParseIP(sourceAddress)
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip, Port: sourcePort}
+	}
+	return &net.TCPAddr{IP: ip, Port: sourcePort}
+}
+
+// Binds a socket to a network interface, before it connects, when an interface is given.
+func controlInterface(rawConn syscall.RawConn, iface string) error {
+	if iface == "" {
+		return nil
+	}
+	return bindToDevice(rawConn, iface)
+}
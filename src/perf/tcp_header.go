@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+)
+
+// Header sent by a TCP traffic run at the beginning of every connection:
+//
+//	0: magic number (uint32)
+//	4: length of the parameters (uint32)
+//	8: traffic parameters, JSON encoded
+//
+// Integers are encoded in network byte order.
+// Connections that do not begin with this header only carry forward traffic.
+const (
+	tcpHeaderMagic     uint32 = 0x676e7074 // "gnpt"
+	tcpHeaderFixedSize        = 8
+
+	// Upper bound on the size of the traffic parameters.
+	tcpHeaderMaxParamsSize = 64 * 1024
+)
+
+func writeTcpHeader(w io.Writer, params *trafficParams) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, tcpHeaderFixedSize+len(data))
+	binary.BigEndian.PutUint32(buffer[0:], tcpHeaderMagic)
+	binary.BigEndian.PutUint32(buffer[4:], uint32(len(data)))
+	copy(buffer[tcpHeaderFixedSize:], data)
+	_, err = w.Write(buffer)
+	return err
+}
+
+// Reads the header at the beginning of a connection.
+//
+// Returns nil parameters when the connection does not begin with a header, along with the
+// bytes consumed from the connection while looking for it.
+func readTcpHeader(r io.Reader) (*trafficParams, []byte, error) {
+	var fixed [tcpHeaderFixedSize]byte
+	nbytes, err := io.ReadFull(r, fixed[:])
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err != nil || binary.BigEndian.Uint32(fixed[0:]) != tcpHeaderMagic {
+		return nil, fixed[0:nbytes], err
+	}
+
+	size := binary.BigEndian.Uint32(fixed[4:])
+	if size > tcpHeaderMaxParamsSize {
+		return nil, fixed[0:nbytes], nil
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+	params := &trafficParams{}
+	if err := json.Unmarshal(data, params); err != nil {
+		return nil, nil, err
+	}
+	return params, nil, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Reported by readTcpInfo on platforms without TCP_INFO.
+var errTcpInfoUnsupported = errors.New("TCP_INFO is not supported on this platform")
+
+// Kernel statistics of a TCP connection, sampled from TCP_INFO.
+type TcpInfo struct {
+	// Time of the sample, in UNIX nanoseconds
+	Time int64 `json:time`
+
+	// Smoothed round-trip time, its variance and the lowest round-trip time observed,
+	// in microseconds
+	RttUs    uint32 `json:rttUs`
+	RttVarUs uint32 `json:rttVarUs`
+	MinRttUs uint32 `json:minRttUs`
+
+	// Congestion window and slow start threshold, in segments
+	SndCwnd     uint32 `json:sndCwnd`
+	SndSsthresh uint32 `json:sndSsthresh`
+	SndMss      uint32 `json:sndMss`
+
+	// Segments in flight, and those of them considered lost
+	Unacked uint32 `json:unacked`
+	Lost    uint32 `json:lost`
+
+	// Retransmitted segments since the connection was established
+	TotalRetrans uint32 `json:totalRetrans`
+	BytesRetrans uint64 `json:bytesRetrans`
+
+	// In bytes per second
+	DeliveryRate uint64 `json:deliveryRate`
+	PacingRate   uint64 `json:pacingRate`
+
+	BytesAcked    uint64 `json:bytesAcked`
+	BytesReceived uint64 `json:bytesReceived`
+
+	// Bytes written by the application but not sent yet
+	NotsentBytes uint32 `json:notsentBytes`
+
+	// Send window advertised by the peer, and receive window advertised to it, in bytes
+	SndWnd uint32 `json:sndWnd`
+	RcvWnd uint32 `json:rcvWnd`
+
+	// Time spent sending data, and time during which sending was limited by the receive window
+	// of the peer or by the send buffer (i.e. by the application), in microseconds
+	BusyTimeUs      uint64 `json:busyTimeUs`
+	RwndLimitedUs   uint64 `json:rwndLimitedUs`
+	SndbufLimitedUs uint64 `json:sndbufLimitedUs`
+}
+
+// Samples TCP_INFO from a connection. Returns nil if not available, and logs why.
+func sampleTcpInfo(conn *net.TCPConn) *TcpInfo {
+	info, err := readTcpInfo(conn)
+	if err != nil {
+		if err != errTcpInfoUnsupported {
+			glog.V(1).Infof("Error reading TCP_INFO of connection to %s: %s",
+				conn.RemoteAddr(), err)
+		}
+		return nil
+	}
+	info.Time = time.Now().UnixNano()
+	return info
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func readTcpInfo(conn *net.TCPConn) (*TcpInfo, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var raw *unix.TCPInfo
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		raw, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return &TcpInfo{
+		RttUs:           raw.Rtt,
+		RttVarUs:        raw.Rttvar,
+		MinRttUs:        raw.Min_rtt,
+		SndCwnd:         raw.Snd_cwnd,
+		SndSsthresh:     raw.Snd_ssthresh,
+		SndMss:          raw.Snd_mss,
+		Unacked:         raw.Unacked,
+		Lost:            raw.Lost,
+		TotalRetrans:    raw.Total_retrans,
+		BytesRetrans:    raw.Bytes_retrans,
+		DeliveryRate:    raw.Delivery_rate,
+		PacingRate:      raw.Pacing_rate,
+		BytesAcked:      raw.Bytes_acked,
+		BytesReceived:   raw.Bytes_received,
+		NotsentBytes:    raw.Notsent_bytes,
+		SndWnd:          raw.Snd_wnd,
+		RcvWnd:          raw.Rcv_wnd,
+		BusyTimeUs:      raw.Busy_time,
+		RwndLimitedUs:   raw.Rwnd_limited,
+		SndbufLimitedUs: raw.Sndbuf_limited,
+	}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+func readTcpInfo(conn *net.TCPConn) (*TcpInfo, error) {
+	return nil, errTcpInfoUnsupported
+}
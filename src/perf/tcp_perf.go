@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -12,40 +18,367 @@ import (
 var (
 	flagTcpReadBufferSize = flag.Uint64("tcp-read-buffer-size", 16*1024,
 		"Size of the buffer used when reading from a TCP connection.")
+
+	flagTcpReceiverHistory = flag.Int("tcp-receiver-history", 1000,
+		"Number of terminated TCP connections to keep track of.")
+
+	flagTcpSocketOptions = flag.String("tcp-socket-options", "",
+		"Socket options of accepted TCP connections, as JSON (e.g. '{\"ReceiveBuffer\": 4194304}').")
+)
+
+// Socket options of accepted TCP connections, parsed from --tcp-socket-options.
+var tcpSocketOptions = &SocketOptions{}
+
+// Window over which the instantaneous goodput of a receiver connection is computed.
+const tcpReceiverRateWindow = time.Second
+
+// Reasons for the termination of a receiver connection.
+const (
+	CloseReasonEof     = "eof"
+	CloseReasonReset   = "reset"
+	CloseReasonTimeout = "timeout"
+	CloseReasonError   = "error"
 )
 
+type TcpReceiverListReq struct {
+	// When set, only list connections that are still open.
+	Active bool `json:active`
+}
+
+type TcpReceiverStatusReq struct {
+	Id string `json:id`
+}
+
+// Accounting for the traffic received over one accepted TCP connection.
+type TcpReceiverStatus struct {
+	Id            string `json:id`
+	RemoteAddr    string `json:remoteAddr`
+	LocalAddr     string `json:localAddr`
+	BytesReceived uint64 `json:bytesReceived`
+
+	// Run ID, stream index and direction announced by the traffic run, if any.
+	RunId     string `json:runId`
+	Stream    int    `json:stream`
+	Direction string `json:direction`
+
+	// Bytes sent back to the traffic run, in reverse and bidirectional modes.
+	BytesSent uint64 `json:bytesSent`
+
+	// In UNIX nanoseconds
+	AcceptTime    int64 `json:acceptTime`
+	FirstByteTime int64 `json:firstByteTime`
+	LastByteTime  int64 `json:lastByteTime`
+	CloseTime     int64 `json:closeTime`
+
+	// In bytes per second
+	CurrentGoodput float64 `json:currentGoodput`
+	AverageGoodput float64 `json:averageGoodput`
+
+	// Close reason and error are empty while the connection is open.
+	Closed      bool   `json:closed`
+	CloseReason string `json:closeReason`
+	CloseError  string `json:closeError`
+
+	// Latest kernel statistics of the connection, when available.
+	TcpInfo *TcpInfo `json:tcpInfo`
+
+	// Congestion control algorithm in effect on the connection, for the reverse traffic.
+	CongestionControl string `json:congestionControl`
+
+	// Socket options in effect on the connection, when available.
+	SocketOptions *SocketOptionValues `json:socketOptions`
+
+	// DSCP marking of the packets received last, -1 when unknown.
+	ReceivedDscp int `json:receivedDscp`
+
+	// Number of samples of the DSCP marking, taken every report interval, with each value.
+	DscpCounts map[int]uint64 `json:dscpCounts`
+}
+
+type tcpReceiverConn struct {
+	mutex  sync.Mutex
+	status TcpReceiverStatus
+	meter  rateMeter
+}
+
+func (c *tcpReceiverConn) addBytes(nbytes int) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.status.FirstByteTime == 0 {
+		c.status.FirstByteTime = now.UnixNano()
+	}
+	c.status.LastByteTime = now.UnixNano()
+	c.status.BytesReceived += uint64(nbytes)
+	c.meter.Add(now, uint64(nbytes))
+}
+
+func (c *tcpReceiverConn) addBytesSent(nbytes int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.BytesSent += uint64(nbytes)
+}
+
+func (c *tcpReceiverConn) setParams(params *trafficParams, congestionControl string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.RunId = params.RunId
+	c.status.Stream = params.Stream
+	c.status.Direction = params.Direction
+	c.status.CongestionControl = congestionControl
+}
+
+func (c *tcpReceiverConn) setSocketOptions(values *SocketOptionValues) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.SocketOptions = values
+}
+
+func (c *tcpReceiverConn) setTcpInfo(info *TcpInfo, dscp int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if info != nil {
+		c.status.TcpInfo = info
+	}
+	if dscp >= 0 {
+		c.status.ReceivedDscp = dscp
+		if c.status.DscpCounts == nil {
+			c.status.DscpCounts = make(map[int]uint64)
+		}
+		c.status.DscpCounts[dscp] += 1
+	}
+}
+
+func (c *tcpReceiverConn) close(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status.Closed = true
+	c.status.CloseTime = time.Now().UnixNano()
+	c.status.CloseReason = closeReason(err)
+	if c.status.CloseReason != CloseReasonEof {
+		c.status.CloseError = err.Error()
+	}
+}
+
+// Returns a copy of the connection status, with goodputs evaluated at the current time.
+func (c *tcpReceiverConn) Snapshot() TcpReceiverStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := c.status
+	if status.Closed {
+		status.CurrentGoodput = 0
+	} else {
+		status.CurrentGoodput = c.meter.Rate(time.Now())
+	}
+	status.AverageGoodput =
+		averageRate(status.BytesReceived, status.FirstByteTime, status.LastByteTime)
+	status.DscpCounts = make(map[int]uint64, len(c.status.DscpCounts))
+	for dscp, count := range c.status.DscpCounts {
+		status.DscpCounts[dscp] = count
+	}
+	return status
+}
+
+// Classifies the error that terminated a connection.
+func closeReason(err error) string {
+	if err == io.EOF {
+		return CloseReasonEof
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return CloseReasonTimeout
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return CloseReasonReset
+	}
+	return CloseReasonError
+}
+
+// Registry of the connections accepted by the TCP sink.
+type tcpReceiverRegistry struct {
+	mutex sync.Mutex
+	count uint64
+	conns map[string]*tcpReceiverConn
+
+	// IDs of the terminated connections, oldest first.
+	finished []string
+}
+
+var tcpReceivers = &tcpReceiverRegistry{conns: make(map[string]*tcpReceiverConn)}
+
+func (r *tcpReceiverRegistry) Add(conn *net.TCPConn) *tcpReceiverConn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c := &tcpReceiverConn{meter: newRateMeter(tcpReceiverRateWindow)}
+	c.status.Id = fmt.Sprintf("%s-rx-%d", serverId, r.count)
+	c.status.RemoteAddr = conn.RemoteAddr().String()
+	c.status.LocalAddr = conn.LocalAddr().String()
+	c.status.AcceptTime = time.Now().UnixNano()
+	c.status.ReceivedDscp = -1
+	r.count += 1
+	r.conns[c.status.Id] = c
+	return c
+}
+
+// Records the termination of a connection, and forgets the oldest terminated connections.
+func (r *tcpReceiverRegistry) Close(c *tcpReceiverConn, err error) {
+	c.close(err)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.finished = append(r.finished, c.status.Id)
+	for len(r.finished) > *flagTcpReceiverHistory {
+		delete(r.conns, r.finished[0])
+		r.finished = r.finished[1:]
+	}
+}
+
+func (r *tcpReceiverRegistry) Get(id string) (TcpReceiverStatus, bool) {
+	r.mutex.Lock()
+	c, ok := r.conns[id]
+	r.mutex.Unlock()
+	if !ok {
+		return TcpReceiverStatus{}, false
+	}
+	return c.Snapshot(), true
+}
+
+// Lists the connections in the order they were accepted.
+func (r *tcpReceiverRegistry) List(activeOnly bool) []TcpReceiverStatus {
+	r.mutex.Lock()
+	conns := make([]*tcpReceiverConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mutex.Unlock()
+
+	statuses := make([]TcpReceiverStatus, 0, len(conns))
+	for _, c := range conns {
+		status := c.Snapshot()
+		if activeOnly && status.Closed {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].AcceptTime < statuses[j].AcceptTime
+	})
+	return statuses
+}
+
 func handleTcpConnection(conn *net.TCPConn) {
 	defer conn.Close()
 	var buffer = make([]byte, *flagTcpReadBufferSize)
 
-	var totalBytes = uint64(0)
-	for {
-		nbytes, err := conn.Read(buffer)
-		if err == io.EOF {
-			break
+	receiver := tcpReceivers.Add(conn)
+	if err := tcpSocketOptions.applyTcpConn(conn); err != nil {
+		glog.Errorf("Error applying socket options to TCP connection from %s: %s\n",
+			conn.RemoteAddr(), err)
+	}
+	receiver.setSocketOptions(readSocketOptions(conn, true))
+	stopSampling := startIntervalReports(
+		time.Duration(*flagDefaultReportIntervalMs)*time.Millisecond, func() {
+			receiver.setTcpInfo(sampleTcpInfo(conn), readReceivedDscp(conn))
+		})
+	var reverse sync.WaitGroup
+	params, consumed, err := readTcpHeader(conn)
+	if len(consumed) > 0 {
+		receiver.addBytes(len(consumed))
+	}
+	if params != nil {
+		if params.Reverse() && params.CongestionControl != "" {
+			setReverseCongestionControl(conn, params)
 		}
-		if err != nil {
-			glog.Fatal("Error reading from TCP connection:", err)
+		receiver.setParams(params, readCongestionControl(conn))
+		if params.Reverse() {
+			reverse.Add(1)
+			go func() {
+				defer reverse.Done()
+				sendTcpReverse(conn, receiver, params)
+			}()
 		}
-		glog.V(1).Infof("Received %d bytes from %s\n", nbytes, conn.RemoteAddr())
-		totalBytes += uint64(nbytes)
+	}
+
+	for err == nil {
+		var nbytes int
+		nbytes, err = conn.Read(buffer)
+		if nbytes > 0 {
+			glog.V(1).Infof("Received %d bytes from %s\n", nbytes, conn.RemoteAddr())
+			receiver.addBytes(nbytes)
+		}
+	}
+	reverse.Wait()
+	stopSampling()
+	tcpReceivers.Close(receiver, err)
+
+	status := receiver.Snapshot()
+	if status.CloseReason != CloseReasonEof {
+		glog.Errorf("Error reading from TCP connection %s: %s\n", status.Id, err)
 	}
 	glog.Info(
-		"TCP connection terminated with ", totalBytes, " bytes received ",
+		"TCP connection ", status.Id, " terminated (", status.CloseReason, ") with ",
+		status.BytesReceived, " bytes received and ", status.BytesSent, " bytes sent ",
 		"from remote ", conn.RemoteAddr(), " and local ", conn.LocalAddr())
 }
 
-func startTcpService(port int) {
-	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", port))
+// Applies the congestion control algorithm a traffic run requested for its reverse traffic.
+// Failures are logged, and the reverse traffic uses the system default instead.
+func setReverseCongestionControl(conn *net.TCPConn, params *trafficParams) {
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		err = setCongestionControl(rawConn, params.CongestionControl)
+	}
 	if err != nil {
-		glog.Fatal("Error resolving TCP address:", err)
+		glog.Errorf("Error setting congestion control of reverse TCP traffic for run '%s': %s\n",
+			params.RunId, err)
+	}
+}
+
+// Sends the reverse traffic requested by a traffic run over an accepted connection.
+// The traffic stops early when the run closes the connection, as writes then fail.
+func sendTcpReverse(conn *net.TCPConn, receiver *tcpReceiverConn, params *trafficParams) {
+	ctx, cancel := params.withEndTime(context.Background())
+	defer cancel()
+	loop := newReverseSendLoop(
+		ctx, fmt.Sprintf("reverse TCP traffic for run '%s'", params.RunId), params)
+	loop.write = func(buffer []byte) (int, error) {
+		nbytes, err := conn.Write(buffer)
+		receiver.addBytesSent(nbytes)
+		return nbytes, err
+	}
+	if _, err := loop.Run(); err != nil {
+		if reason := closeReason(err); reason != CloseReasonError {
+			glog.Infof("Reverse TCP traffic for run '%s' interrupted (%s)", params.RunId, reason)
+		} else {
+			glog.Errorf("Error sending reverse TCP traffic to %s: %s\n", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	conn.CloseWrite()
+}
+
+func startTcpService(port int) {
+	var err error
+	if tcpSocketOptions, err = parseSocketOptions(*flagTcpSocketOptions); err != nil {
+		glog.Fatal(err)
+	}
+	// Accepted connections inherit the buffers and segment size of the listening socket:
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, rawConn syscall.RawConn) error {
+			if err := enableRecvTos(rawConn, network); err != nil {
+				glog.Warningf("Not reporting DSCP of TCP connections: %s", err)
+			}
+			return setSocketOptions(rawConn, tcpSocketOptions)
+		},
 	}
-	if listener, err := net.ListenTCP("tcp", addr); err != nil {
+	// Multipath TCP sockets do not support all the TCP and IP options:
+	listenConfig.SetMultipathTCP(false)
+	// Listens on both address families:
+	address := fmt.Sprintf(":%d", port)
+	if listener, err := listenConfig.Listen(context.Background(), "tcp", address); err != nil {
 		glog.Fatal("Error setting up listener for TCP connections:", err)
 	} else {
 		glog.Infof("Listening for TCP connections on %s\n", listener.Addr())
 		for {
-			if conn, err := listener.AcceptTCP(); err != nil {
+			if conn, err := listener.(*net.TCPListener).AcceptTCP(); err != nil {
 				glog.Info("Error accepting TCP connection:", err)
 			} else {
 				glog.Info("Accepted TCP connection with remote ", conn.RemoteAddr(), " and local ", conn.LocalAddr())
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 )
 
+// Upper bound on the number of parallel streams of a TCP run.
+const maxTcpStreams = 128
+
 type TcpReq struct {
 	Target   string `json:target`
 	MaxBytes uint64 `json:maxBytes`
@@ -21,6 +28,44 @@ type TcpReq struct {
 
 	// Optional end time (unix Epoch time, in seconds)
 	EndTime uint64 `json:endTime`
+
+	// Direction of the traffic: forward (default), reverse or bidirectional.
+	// In reverse mode, the target sends MaxBytes back over the connection.
+	Direction string `json:direction`
+
+	// Number of parallel connections (default 1). MaxBytes is split between them.
+	Streams int `json:streams`
+
+	// Optional target rate of the traffic, in bits per second, split between the streams.
+	RateBps uint64 `json:rateBps`
+
+	// Time interval in between the interval reports of the run (default 1 s).
+	ReportIntervalMs uint64 `json:reportIntervalMs`
+
+	// Optional congestion control algorithm (e.g. cubic, reno, bbr), instead of the system
+	// default. The target uses the same algorithm for reverse traffic.
+	CongestionControl string `json:congestionControl`
+
+	// Optional socket options of the connections.
+	SocketOptions *SocketOptions `json:socketOptions`
+
+	// Optional DSCP value (0-63) marking the traffic sent by the run.
+	Dscp int `json:dscp`
+
+	// Optional address family of the target: ipv4 or ipv6. By default, whichever family
+	// the target resolves to first.
+	AddressFamily string `json:addressFamily`
+
+	// Optional local IP address and port the traffic leaves from, and network interface the
+	// socket is bound to (SO_BINDTODEVICE).
+	SourceAddress string `json:sourceAddress`
+	SourcePort    int    `json:sourcePort`
+	Interface     string `json:interface`
+
+	// How the data is handed to the kernel: copy (default) from a buffer, sendfile from
+	// SendFile, the name of a file in the data directory, or zerocopy with MSG_ZEROCOPY.
+	SendMode string `json:sendMode`
+	SendFile string `json:sendFile`
 }
 
 type TcpStopReq struct {
@@ -32,46 +77,317 @@ type TcpStatusReq struct {
 }
 
 type TcpRun struct {
-	Id        string  `json:id`
-	BytesSent uint64  `json:bytesSent`
-	Req       *TcpReq `json:req`
-	StopReq   bool
+	Id            string  `json:id`
+	BytesSent     uint64  `json:bytesSent`
+	BytesReceived uint64  `json:bytesReceived`
+	Req           *TcpReq `json:req`
+
+	RunLifecycle
 
 	// In UNIX nanoseconds
 	TrafficStartTime int64 `json:trafficStartTime`
 	TrafficEndTime   int64 `json:trafficEndTime`
+
+	// Average rates since the traffic started, in bytes per second
+	SendRate    float64 `json:sendRate`
+	ReceiveRate float64 `json:receiveRate`
+
+	// Jain's fairness index of the rates of the streams, from 1/N (one stream got all the
+	// bandwidth) to 1 (all streams got the same share).
+	SendFairness    float64 `json:sendFairness`
+	ReceiveFairness float64 `json:receiveFairness`
+
+	// Average rate of the paced traffic (sent, or received in reverse mode), in bits per second,
+	// and its ratio to the target rate. Only set when the run has a target rate.
+	AchievedRateBps float64 `json:achievedRateBps`
+	RateAccuracy    float64 `json:rateAccuracy`
+
+	// CPU time used by the agent process while the traffic ran, in nanoseconds, and bytes sent
+	// and received per second of CPU time, to compare send modes. This includes any other
+	// traffic the agent handled meanwhile.
+	UserCpuNs         int64   `json:userCpuNs`
+	SystemCpuNs       int64   `json:systemCpuNs`
+	BytesPerCpuSecond float64 `json:bytesPerCpuSecond`
+
+	Streams []*TcpStream `json:streams`
+
+	// Traffic of the run over every reporting interval, oldest first.
+	Intervals []TcpIntervalReport `json:intervals`
+
+	// Guards the status of the run and of its streams.
+	mutex *sync.Mutex
+
+	// Cancelled when the run is stopped.
+	ctx context.Context
+
+	// Interrupts the traffic of all the streams, once started.
+	cancelTraffic context.CancelFunc
+
+	// Counters at the end of the last reported interval.
+	lastReport intervalCounters
+
+	// CPU usage of the process when the traffic started, and when it ended.
+	cpuStart cpuUsage
+	cpuEnd   cpuUsage
+}
+
+// Traffic of a TCP run over one reporting interval.
+type TcpIntervalReport struct {
+	IntervalReport
+
+	// Segments retransmitted during the interval, over all the streams.
+	Retransmits uint32 `json:retransmits`
+
+	// Kernel statistics of every stream at the end of the interval, when available.
+	TcpInfo []*TcpInfo `json:tcpInfo`
+}
+
+// Traffic of one connection of a TCP run.
+type TcpStream struct {
+	Index      int    `json:index`
+	LocalAddr  string `json:localAddr`
+	RemoteAddr string `json:remoteAddr`
+
+	// Address family of the connection: ipv4 or ipv6.
+	AddressFamily string `json:addressFamily`
+
+	// Share of the bytes and of the target rate of the run for this stream, if limited.
+	MaxBytes uint64 `json:maxBytes`
+	RateBps  uint64 `json:rateBps`
+
+	BytesSent     uint64 `json:bytesSent`
+	BytesReceived uint64 `json:bytesReceived`
+
+	// Average rates since the traffic started, in bytes per second
+	SendRate    float64 `json:sendRate`
+	ReceiveRate float64 `json:receiveRate`
+
+	// Latest kernel statistics of the connection, when available.
+	TcpInfo *TcpInfo `json:tcpInfo`
+
+	// Congestion control algorithm in effect on the connection, for the forward traffic.
+	// Reverse traffic is reported by the target in /tcp/receiver/status.
+	CongestionControl string `json:congestionControl`
+
+	// Socket options in effect on the connection, when available.
+	SocketOptions *SocketOptionValues `json:socketOptions`
+
+	// In zerocopy send mode, number of writes the kernel completed by copying the data after
+	// all, e.g. over loopback or when the network interface cannot take the pages as is.
+	ZerocopyCopied uint64 `json:zerocopyCopied`
+
+	// Time of the last write and of the last read, in UNIX nanoseconds
+	lastSendTime    int64
+	lastReceiveTime int64
+
+	// Set once connected.
+	conn *net.TCPConn
 }
 
 var (
-	tcpRuns            = make(map[string]*TcpRun)
+	tcpRuns            = newRunManager()
 	tcpRunCount uint64 = 0
 )
 
-func NewTcpRun(req *TcpReq) *TcpRun {
+func NewTcpRun(req *TcpReq) (*TcpRun, error) {
 	if req.WriteSize == 0 {
 		req.WriteSize = 1024
 	}
+	direction, err := checkDirection(req.Direction)
+	if err != nil {
+		return nil, err
+	}
+	req.Direction = direction
+	if req.Streams == 0 {
+		req.Streams = 1
+	}
+	if req.Streams < 0 || req.Streams > maxTcpStreams {
+		return nil, fmt.Errorf("Invalid number of TCP streams %d, must be within [1, %d]",
+			req.Streams, maxTcpStreams)
+	}
+	if req.MaxBytes > 0 && req.MaxBytes < uint64(req.Streams) {
+		return nil, fmt.Errorf("Cannot split %d bytes between %d TCP streams",
+			req.MaxBytes, req.Streams)
+	}
+	if req.RateBps > 0 && req.RateBps < uint64(req.Streams) {
+		return nil, fmt.Errorf("Cannot split %d b/s between %d TCP streams",
+			req.RateBps, req.Streams)
+	}
+	if req.ReportIntervalMs, err = checkReportInterval(req.ReportIntervalMs); err != nil {
+		return nil, err
+	}
+	if err := checkDscp(req.Dscp); err != nil {
+		return nil, err
+	}
+	if err := checkAddressFamily(req.AddressFamily); err != nil {
+		return nil, err
+	}
+	if err := checkSource(req.SourceAddress, req.SourcePort); err != nil {
+		return nil, err
+	}
+	if req.SourcePort > 0 && req.Streams > 1 {
+		return nil, fmt.Errorf("Cannot bind %d TCP streams to the same source port", req.Streams)
+	}
+	if req.SendMode, err = checkSendMode(req.SendMode, req.SendFile); err != nil {
+		return nil, err
+	}
 
-	run := &TcpRun{}
+	run := &TcpRun{RunLifecycle: newRunLifecycle(), mutex: &sync.Mutex{}}
 	runId := atomic.AddUint64(&tcpRunCount, 1) - 1
 	run.Id = fmt.Sprintf("%s-%d", serverId, runId)
 	run.Req = req
 
-	tcpRuns[run.Id] = run
-	return run
+	run.Streams = make([]*TcpStream, req.Streams)
+	for i := range run.Streams {
+		run.Streams[i] = &TcpStream{Index: i}
+		if req.MaxBytes > 0 {
+			run.Streams[i].MaxBytes = req.MaxBytes / uint64(req.Streams)
+			if uint64(i) < req.MaxBytes%uint64(req.Streams) {
+				run.Streams[i].MaxBytes += 1
+			}
+		}
+		run.Streams[i].RateBps = req.RateBps / uint64(req.Streams)
+	}
+
+	run.ctx, _ = tcpRuns.Add(run.Id, run)
+	return run, nil
+}
+
+// Returns a copy of the run status, safe to serialize while the run goes on.
+func (run *TcpRun) Snapshot() *TcpRun {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	snapshot := *run
+	snapshot.RunLifecycle = run.RunLifecycle.copy()
+	snapshot.Intervals = append([]TcpIntervalReport(nil), run.Intervals...)
+	now := run.TrafficEndTime
+	if now == 0 {
+		now = time.Now().UnixNano()
+	}
+
+	snapshot.Streams = make([]*TcpStream, len(run.Streams))
+	sendRates := make([]float64, len(run.Streams))
+	receiveRates := make([]float64, len(run.Streams))
+	for i, stream := range run.Streams {
+		streamCopy := *stream
+		streamCopy.SendRate =
+			averageRate(stream.BytesSent, run.TrafficStartTime, stream.lastSendTime)
+		streamCopy.ReceiveRate =
+			averageRate(stream.BytesReceived, run.TrafficStartTime, stream.lastReceiveTime)
+		snapshot.Streams[i] = &streamCopy
+		snapshot.BytesSent += stream.BytesSent
+		snapshot.BytesReceived += stream.BytesReceived
+		sendRates[i] = streamCopy.SendRate
+		receiveRates[i] = streamCopy.ReceiveRate
+	}
+	snapshot.SendRate = averageRate(snapshot.BytesSent, run.TrafficStartTime, now)
+	snapshot.ReceiveRate = averageRate(snapshot.BytesReceived, run.TrafficStartTime, now)
+	snapshot.SendFairness = jainFairness(sendRates)
+	snapshot.ReceiveFairness = jainFairness(receiveRates)
+	if run.Req.RateBps > 0 {
+		if run.Req.Direction == DirectionReverse {
+			snapshot.AchievedRateBps = snapshot.ReceiveRate * 8
+		} else {
+			snapshot.AchievedRateBps = snapshot.SendRate * 8
+		}
+		snapshot.RateAccuracy = snapshot.AchievedRateBps / float64(run.Req.RateBps)
+	}
+	if run.TrafficStartTime > 0 {
+		cpuEnd := run.cpuEnd
+		if run.TrafficEndTime == 0 {
+			cpuEnd = readCpuUsage()
+		}
+		snapshot.UserCpuNs = cpuEnd.user - run.cpuStart.user
+		snapshot.SystemCpuNs = cpuEnd.system - run.cpuStart.system
+		if cpuNs := snapshot.UserCpuNs + snapshot.SystemCpuNs; cpuNs > 0 {
+			snapshot.BytesPerCpuSecond =
+				float64(snapshot.BytesSent+snapshot.BytesReceived) * 1e9 / float64(cpuNs)
+		}
+	}
+	return &snapshot
+}
+
+func (run *TcpRun) addSent(stream *TcpStream, nbytes int) {
+	now := time.Now().UnixNano()
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	stream.BytesSent += uint64(nbytes)
+	stream.lastSendTime = now
+}
+
+func (run *TcpRun) setZerocopyCopied(stream *TcpStream, copied uint64) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	stream.ZerocopyCopied = copied
 }
 
-func (run *TcpRun) Stop() {
-	run.StopReq = true
+func (run *TcpRun) addReceived(stream *TcpStream, nbytes int) {
+	now := time.Now().UnixNano()
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	stream.BytesReceived += uint64(nbytes)
+	stream.lastReceiveTime = now
+}
+
+// Closes the current reporting interval, and starts the next one.
+func (run *TcpRun) reportInterval() {
+	// Streams are all connected before reports start:
+	infos := make([]*TcpInfo, len(run.Streams))
+	for i, stream := range run.Streams {
+		infos[i] = sampleTcpInfo(stream.conn)
+	}
+
+	now := time.Now().UnixNano()
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	counters := intervalCounters{time: now}
+	report := TcpIntervalReport{TcpInfo: infos}
+	for i, stream := range run.Streams {
+		counters.bytesSent += stream.BytesSent
+		counters.bytesReceived += stream.BytesReceived
+		if infos[i] != nil {
+			if stream.TcpInfo != nil {
+				report.Retransmits += infos[i].TotalRetrans - stream.TcpInfo.TotalRetrans
+			} else {
+				report.Retransmits += infos[i].TotalRetrans
+			}
+			stream.TcpInfo = infos[i]
+		}
+	}
+	report.IntervalReport = newIntervalReport(&run.lastReport, &counters)
+	if reportHistoryFull(len(run.Intervals)) {
+		run.Intervals = run.Intervals[1:]
+	}
+	run.Intervals = append(run.Intervals, report)
+	run.lastReport = counters
+}
+
+func (run *TcpRun) setState(state string) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.transition(state)
+}
+
+// Records the error that interrupted a stream, and interrupts the traffic of the other streams.
+func (run *TcpRun) abort(reason string, err error) {
+	run.mutex.Lock()
+	run.fail(reason, err)
+	cancel := run.cancelTraffic
+	run.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
 }
 
-func (run *TcpRun) waitForStartTime() {
+// Waits for the start time of the run, if any. Returns false if the run is stopped first.
+func (run *TcpRun) waitForStartTime() bool {
 	if run.Req.StartTime > 0 {
 		startTime := time.Unix(int64(run.Req.StartTime), 0)
 		glog.Infof("TCP traffic '%s' beginning in %.03f seconds",
 			run.Id, startTime.Sub(time.Now()).Seconds())
-		time.Sleep(startTime.Sub(time.Now()))
+		return sleepContext(run.ctx, startTime.Sub(time.Now()))
 	}
+	return run.ctx.Err() == nil
 }
 
 func (run *TcpRun) getEndTime() (hasEndTime bool, endTime time.Time) {
@@ -82,66 +398,239 @@ func (run *TcpRun) getEndTime() (hasEndTime bool, endTime time.Time) {
 	return
 }
 
+func (run *TcpRun) trafficParams(stream *TcpStream) *trafficParams {
+	return &trafficParams{
+		RunId:             run.Id,
+		Stream:            stream.Index,
+		Direction:         run.Req.Direction,
+		MaxBytes:          stream.MaxBytes,
+		WriteSize:         run.Req.WriteSize,
+		WriteIntervalMs:   run.Req.WriteIntervalMs,
+		EndTime:           run.Req.EndTime,
+		RateBps:           stream.RateBps,
+		CongestionControl: run.Req.CongestionControl,
+	}
+}
+
 func (run *TcpRun) Process() {
 	req := run.Req
-	bufferSize := req.WriteSize
+	defer func() {
+		run.mutex.Lock()
+		run.finish(run.ctx)
+		run.mutex.Unlock()
+	}()
 
-	time0 := time.Now()
-	conn, err := net.Dial("tcp", req.Target)
-	if err != nil {
-		glog.Errorf("Error connecting to TCP target '%s': %s\n", req.Target, err)
-		return
+	dialer := net.Dialer{
+		LocalAddr: sourceAddr("tcp", req.SourceAddress, req.SourcePort),
+		Control:   run.controlSocket,
+	}
+	conns := make([]*net.TCPConn, 0, len(run.Streams))
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, stream := range run.Streams {
+		time0 := time.Now()
+		conn, err := dialer.DialContext(
+			run.ctx, familyNetwork("tcp", req.AddressFamily), req.Target)
+		if err != nil {
+			if run.ctx.Err() == nil {
+				glog.Errorf("Error connecting to TCP target '%s': %s\n", req.Target, err)
+				run.abort(failureReason(err, FailureConnect), err)
+			}
+			return
+		}
+		time1 := time.Now()
+		tcpConn := conn.(*net.TCPConn)
+		conns = append(conns, tcpConn)
+		if req.SocketOptions != nil {
+			if err := req.SocketOptions.applyTcpConn(tcpConn); err != nil {
+				glog.Errorf("Error applying socket options to TCP connection to '%s': %s\n",
+					req.Target, err)
+				run.abort(failureReason(err, FailureSockopt), err)
+				return
+			}
+		}
+		congestionControl := readCongestionControl(tcpConn)
+		socketOptions := readSocketOptions(tcpConn, true)
+		run.mutex.Lock()
+		stream.LocalAddr = conn.LocalAddr().String()
+		stream.RemoteAddr = conn.RemoteAddr().String()
+		stream.AddressFamily = addressFamily(conn.RemoteAddr())
+		stream.CongestionControl = congestionControl
+		stream.SocketOptions = socketOptions
+		stream.conn = tcpConn
+		run.mutex.Unlock()
+		glog.Infof("Established connection #%d to TCP target '%s' from %s to %s in %d ns\n",
+			stream.Index, req.Target, conn.LocalAddr(), conn.RemoteAddr(),
+			time1.Sub(time0).Nanoseconds())
 	}
-	time1 := time.Now()
-	defer conn.Close()
-	glog.Infof("Established connection to TCP target '%s' from %s to %s\n",
-		req.Target, conn.LocalAddr(), conn.RemoteAddr())
 
-	run.waitForStartTime()
-	glog.Infof("Beginning TCP traffic '%s'", run.Id)
+	if req.StartTime > 0 {
+		run.setState(RunWaitingForStart)
+	}
+	if !run.waitForStartTime() {
+		glog.Infof("TCP traffic run '%s' stopped before starting", run.Id)
+		return
+	}
+	glog.Infof("Beginning %s TCP traffic '%s' over %d streams",
+		req.Direction, run.Id, len(run.Streams))
 
 	hasEndTime, endTime := run.getEndTime()
-
-	var data = make([]byte, bufferSize)
+	ctx, cancel := withEndTime(run.ctx, hasEndTime, endTime)
+	defer cancel()
+	run.mutex.Lock()
 	run.TrafficStartTime = time.Now().UnixNano()
-	var lastSendTime time.Time
-	for {
-		if run.StopReq {
-			glog.Infof("Stopping TCP traffic run '%s'", run.Id)
-			break
+	run.cpuStart = readCpuUsage()
+	run.lastReport = intervalCounters{time: run.TrafficStartTime}
+	run.cancelTraffic = cancel
+	run.transition(RunRunning)
+	run.mutex.Unlock()
+	stopReports := startIntervalReports(
+		time.Duration(req.ReportIntervalMs)*time.Millisecond, run.reportInterval)
+	var wg sync.WaitGroup
+	for i, stream := range run.Streams {
+		wg.Add(1)
+		go func(stream *TcpStream, conn *net.TCPConn) {
+			defer wg.Done()
+			run.processStream(ctx, stream, conn)
+		}(stream, conns[i])
+	}
+	wg.Wait()
+	stopReports()
+
+	run.mutex.Lock()
+	run.TrafficEndTime = time.Now().UnixNano()
+	run.cpuEnd = readCpuUsage()
+	run.mutex.Unlock()
+	status := run.Snapshot()
+	deltaNS := status.TrafficEndTime - status.TrafficStartTime
+	glog.Infof("Completed TCP traffic request: %.03f b/s sent (%d bytes in %d ns), "+
+		"%.03f b/s received (%d bytes), %d ns of CPU time",
+		status.SendRate, status.BytesSent, deltaNS, status.ReceiveRate, status.BytesReceived,
+		status.UserCpuNs+status.SystemCpuNs)
+}
+
+// Applies the socket options of the run to a socket before it connects.
+func (run *TcpRun) controlSocket(network, address string, rawConn syscall.RawConn) error {
+	if err := controlInterface(rawConn, run.Req.Interface); err != nil {
+		return err
+	}
+	if run.Req.CongestionControl != "" {
+		if err := setCongestionControl(rawConn, run.Req.CongestionControl); err != nil {
+			return err
 		}
-		if (req.MaxBytes > 0) && (run.BytesSent >= req.MaxBytes) {
-			glog.Infof("TCP traffic run '%s' completed (max bytes reached)", run.Id)
-			break
+	}
+	if run.Req.Dscp > 0 {
+		if err := setDscp(rawConn, network, run.Req.Dscp); err != nil {
+			return err
 		}
-		if hasEndTime && time.Now().After(endTime) {
-			glog.Infof("TCP traffic run '%s' completed (time is over)", run.Id)
-			break
+	}
+	if run.Req.SocketOptions != nil {
+		return setSocketOptions(rawConn, run.Req.SocketOptions)
+	}
+	return nil
+}
+
+func (run *TcpRun) processStream(ctx context.Context, stream *TcpStream, conn *net.TCPConn) {
+	stopInterrupt := interruptOnCancel(ctx, conn)
+	defer stopInterrupt()
+
+	params := run.trafficParams(stream)
+	if err := writeTcpHeader(conn, params); err != nil {
+		if !trafficDone(ctx, fmt.Sprintf("TCP traffic run '%s'", run.Id)) {
+			glog.Errorf("Error sending traffic header to TCP target '%s': %s\n", run.Req.Target, err)
+			run.abort(failureReason(err, FailureWriteError), err)
 		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	if params.Forward() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.send(ctx, stream, conn)
+			conn.CloseWrite()
+		}()
+	}
+	if params.Reverse() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.receive(ctx, stream, conn)
+		}()
+	}
+	wg.Wait()
+}
 
-		if req.WriteIntervalMs > 0 {
-			var sleepTime = (time.Duration(req.WriteIntervalMs)*time.Millisecond -
-				time.Since(lastSendTime))
-			time.Sleep(sleepTime - time.Duration(1)*time.Millisecond)
+// Sends the forward traffic of a stream.
+func (run *TcpRun) send(ctx context.Context, stream *TcpStream, conn *net.TCPConn) {
+	req := run.Req
+	var writer io.Writer = conn
+	var zerocopy *zerocopyWriter
+	var err error
+	switch req.SendMode {
+	case SendModeSendfile:
+		var sendfile *sendfileWriter
+		if sendfile, err = newSendfileWriter(conn, req.SendFile); err == nil {
+			defer sendfile.Close()
+			writer = sendfile
 		}
-		lastSendTime = time.Now()
-		var buffer = data[0:bufferSize]
-		if req.MaxBytes > 0 {
-			buffer = buffer[0:min(bufferSize, req.MaxBytes-run.BytesSent)]
+	case SendModeZerocopy:
+		if zerocopy, err = newZerocopyWriter(conn); err == nil {
+			writer = zerocopy
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error setting up %s send mode to TCP target '%s': %s\n",
+			req.SendMode, req.Target, err)
+		run.abort(failureReason(err, FailureWriteError), err)
+		return
+	}
+
+	var zerocopyCopied uint64
+	loop := &sendLoop{
+		name:          fmt.Sprintf("TCP traffic run '%s' stream #%d", run.Id, stream.Index),
+		ctx:           ctx,
+		maxBytes:      stream.MaxBytes,
+		writeSize:     req.WriteSize,
+		writeInterval: time.Duration(req.WriteIntervalMs) * time.Millisecond,
+		pacer:         newPacer(stream.RateBps, 0),
+		write: func(buffer []byte) (int, error) {
+			nbytes, err := writer.Write(buffer)
+			run.addSent(stream, nbytes)
+			if zerocopy != nil && zerocopy.copied != zerocopyCopied {
+				zerocopyCopied = zerocopy.copied
+				run.setZerocopyCopied(stream, zerocopyCopied)
+			}
+			return nbytes, err
+		},
+	}
+	if _, err := loop.Run(); err != nil {
+		glog.Errorf("Error sending data over TCP to '%s': %s\n", req.Target, err)
+		run.abort(failureReason(err, FailureWriteError), err)
+	}
+}
+
+// Receives the reverse traffic of a stream, until the target closes the connection.
+func (run *TcpRun) receive(ctx context.Context, stream *TcpStream, conn *net.TCPConn) {
+	name := fmt.Sprintf("reverse TCP traffic run '%s' stream #%d", run.Id, stream.Index)
+	var buffer = make([]byte, *flagTcpReadBufferSize)
+	for {
+		nbytes, err := conn.Read(buffer)
+		run.addReceived(stream, nbytes)
+		if err == io.EOF {
+			glog.Infof("%s completed", name)
+			return
 		}
-		nbytes, err := conn.Write(buffer)
 		if err != nil {
-			glog.Errorf("Error sending data over TCP to '%s': %s\n", req.Target, err)
-			break
+			if !trafficDone(ctx, name) {
+				glog.Errorf("Error receiving data over TCP from '%s': %s\n", run.Req.Target, err)
+				run.abort(failureReason(err, FailureReadError), err)
+			}
+			return
 		}
-		run.BytesSent += uint64(nbytes)
-		glog.V(1).Infof("Sent %d bytes (%d out of %d bytes) from %s to %s over UDP",
-			nbytes, run.BytesSent, req.MaxBytes, conn.LocalAddr(), conn.RemoteAddr())
 	}
-
-	run.TrafficEndTime = time.Now().UnixNano()
-	deltaNS := run.TrafficEndTime - run.TrafficStartTime
-	glog.Infof("Established TCP connection in %d ns", time1.Sub(time0).Nanoseconds())
-	glog.Infof("Completed TCP traffic request: %.03f b/s (%d bytes in %d ns)",
-		float64(run.BytesSent)*1e9/float64(deltaNS), run.BytesSent, deltaNS)
 }
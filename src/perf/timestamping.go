@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// Sources of packet timestamps.
+const (
+	// time.Now() in the agent, before writing or after reading a packet.
+	TimestampUser = "user"
+
+	// The kernel, at the socket layer (SO_TIMESTAMPING).
+	TimestampSoftware = "software"
+
+	// The network interface, when it supports it and is configured to (SO_TIMESTAMPING).
+	TimestampHardware = "hardware"
+)
+
+// Precision of the timestamp sources, from the least precise.
+var timestampPrecision = map[string]int{
+	TimestampUser:     0,
+	TimestampSoftware: 1,
+	TimestampHardware: 2,
+}
+
+// Source of the timestamps used for one set of delay measurements. The sources may not use
+// the same clock, so the measurements only use the most precise source seen so far.
+type timestampSource struct {
+	name string
+}
+
+// Returns whether to use a timestamp from the given source, and whether to discard the
+// measurements made so far, when it is more precise than their source.
+func (s *timestampSource) Use(source string) (use bool, reset bool) {
+	switch {
+	case s.name == source:
+		return true, false
+	case s.name == "":
+		s.name = source
+		return true, false
+	case timestampPrecision[source] > timestampPrecision[s.name]:
+		s.name = source
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// Size of the ring of send times matched with transmit timestamps, a power of 2.
+const txTimestampRingSize = 4096
+
+// Number of datagrams sent between reads of the transmit timestamps. Reading after every
+// datagram would double the system calls of the send path, while the error queue holding the
+// timestamps is bounded by the receive buffer of the socket.
+const txTimestampReadPeriod = 128
+
+// Validates a timestamping mode, and applies the default (user).
+func checkTimestamping(mode string) (string, error) {
+	switch mode {
+	case "":
+		return TimestampUser, nil
+	case TimestampUser, TimestampSoftware, TimestampHardware:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("Invalid timestamping mode '%s'", mode)
+	}
+}
+
+// Matches the transmit timestamps the kernel reports for the datagrams sent on a UDP socket
+// with the user-space send times they carry in their header.
+//
+// The kernel identifies the datagrams by the number of datagrams sent before them on the
+// socket (SOF_TIMESTAMPING_OPT_ID): every datagram sent must be passed to Sent, in order.
+type txTimestamps struct {
+	rawConn syscall.RawConn
+
+	// Room for the control messages of the error queue.
+	oob []byte
+
+	// Send times of the latest datagrams, indexed by key modulo the ring size, and key of the
+	// next datagram.
+	sendTimes [txTimestampRingSize]int64
+	nextKey   uint32
+
+	// Number of datagrams timestamped by each source, and distribution of the times from
+	// their user-space send time to their transmit timestamp, in µs, from a single source.
+	sources map[string]uint64
+	delays  *histogram
+	source  timestampSource
+}
+
+func newTxTimestamps(rawConn syscall.RawConn) *txTimestamps {
+	return &txTimestamps{
+		rawConn: rawConn,
+		oob:     make([]byte, 2*txTimestampControlSize),
+		sources: make(map[string]uint64),
+		delays:  NewHistogram(delayHistogramSize, delayHistogramBase),
+	}
+}
+
+// Records a datagram sent, starting with a traffic header. Control packets carry no send time.
+func (t *txTimestamps) Sent(datagram []byte) {
+	var sendTime int64
+	if len(datagram) >= udpHeaderFixedSize {
+		sendTime = int64(binary.BigEndian.Uint64(datagram[16:]))
+	}
+	t.sendTimes[t.nextKey%txTimestampRingSize] = sendTime
+	t.nextKey += 1
+}
+
+// Reads the transmit timestamps available, and accounts for those of known datagrams.
+func (t *txTimestamps) Read() error {
+	return readTxTimestamps(t.rawConn, t.oob, func(key uint32, timestamp int64, source string) {
+		if t.nextKey-key > txTimestampRingSize || t.nextKey-key == 0 {
+			return
+		}
+		sendTime := t.sendTimes[key%txTimestampRingSize]
+		if sendTime == 0 {
+			return
+		}
+		t.sources[source] += 1
+		use, reset := t.source.Use(source)
+		if reset {
+			*t.delays = *NewHistogram(delayHistogramSize, delayHistogramBase)
+		}
+		if use {
+			t.delays.AddSample(float64(timestamp-sendTime) / 1000)
+		}
+	})
+}
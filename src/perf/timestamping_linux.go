@@ -0,0 +1,114 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Room for the timestamps of a packet in its control messages.
+var timestampingControlSize = unix.CmsgSpace(int(unsafe.Sizeof(unix.ScmTimestamping{})))
+
+// Room for the timestamps and the extended error of a transmit timestamp.
+var txTimestampControlSize = timestampingControlSize +
+	unix.CmsgSpace(int(unsafe.Sizeof(unix.SockExtendedErr{})))
+
+// Enables SO_TIMESTAMPING on a socket: software or hardware timestamps of the packets
+// received, and of the packets sent if tx is set.
+func enableTimestamping(rawConn syscall.RawConn, mode string, tx bool) error {
+	flags := unix.SOF_TIMESTAMPING_SOFTWARE | unix.SOF_TIMESTAMPING_RX_SOFTWARE
+	if tx {
+		flags |= unix.SOF_TIMESTAMPING_TX_SOFTWARE |
+			unix.SOF_TIMESTAMPING_OPT_ID | unix.SOF_TIMESTAMPING_OPT_TSONLY
+	}
+	if mode == TimestampHardware {
+		flags |= unix.SOF_TIMESTAMPING_RAW_HARDWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE
+		if tx {
+			flags |= unix.SOF_TIMESTAMPING_TX_HARDWARE
+		}
+	}
+	err := controlFd(rawConn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags)
+	})
+	if err != nil {
+		return &socketOptionError{"SO_TIMESTAMPING", err}
+	}
+	return nil
+}
+
+// Configures a network interface to timestamp all the packets it sends and receives
+// (SIOCSHWTSTAMP). Requires CAP_NET_ADMIN.
+func enableHardwareTimestamping(iface string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err == nil {
+		defer unix.Close(fd)
+		err = unix.IoctlSetHwTstamp(fd, iface, &unix.HwTstampConfig{
+			Tx_type:   unix.HWTSTAMP_TX_ON,
+			Rx_filter: unix.HWTSTAMP_FILTER_ALL,
+		})
+	}
+	if err != nil {
+		return &socketOptionError{"SIOCSHWTSTAMP on " + iface, err}
+	}
+	return nil
+}
+
+// Extracts the timestamp of a packet, in UNIX nanoseconds, from the data of an
+// SCM_TIMESTAMPING control message: the hardware one if any, the software one otherwise.
+// Returns 0 if the packet has none.
+func parseTimestamping(data []byte) (int64, string) {
+	if len(data) < int(unsafe.Sizeof(unix.ScmTimestamping{})) {
+		return 0, ""
+	}
+	timestamps := (*unix.ScmTimestamping)(unsafe.Pointer(&data[0]))
+	if hardware := timestamps.Ts[2]; hardware.Sec != 0 || hardware.Nsec != 0 {
+		return hardware.Nano(), TimestampHardware
+	}
+	if software := timestamps.Ts[0]; software.Sec != 0 || software.Nsec != 0 {
+		return software.Nano(), TimestampSoftware
+	}
+	return 0, ""
+}
+
+// Reads the transmit timestamps available on the error queue of a socket, and calls fn with
+// the key (SOF_TIMESTAMPING_OPT_ID) and timestamp of every datagram.
+func readTxTimestamps(rawConn syscall.RawConn, oob []byte,
+	fn func(key uint32, timestamp int64, source string)) error {
+
+	err := controlFd(rawConn, func(fd int) error {
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(fd, nil, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				return err
+			}
+			messages, err := unix.ParseSocketControlMessage(oob[0:oobn])
+			if err != nil {
+				return err
+			}
+			var timestamp int64
+			var source string
+			var ee *unix.SockExtendedErr
+			for _, m := range messages {
+				level, kind := m.Header.Level, m.Header.Type
+				switch {
+				case level == unix.SOL_SOCKET && kind == unix.SO_TIMESTAMPING:
+					timestamp, source = parseTimestamping(m.Data)
+				case (level == unix.SOL_IP && kind == unix.IP_RECVERR) ||
+					(level == unix.SOL_IPV6 && kind == unix.IPV6_RECVERR):
+					if len(m.Data) >= int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+						ee = (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+					}
+				}
+			}
+			if ee != nil && ee.Origin == unix.SO_EE_ORIGIN_TIMESTAMPING &&
+				ee.Info == unix.SCM_TSTAMP_SND && timestamp != 0 {
+				fn(ee.Data, timestamp, source)
+			}
+		}
+	})
+	if err == unix.EAGAIN {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+)
+
+var (
+	timestampingControlSize = 0
+	txTimestampControlSize  = 0
+)
+
+func enableTimestamping(rawConn syscall.RawConn, mode string, tx bool) error {
+	return &socketOptionError{"SO_TIMESTAMPING", errSocketOptionUnsupported}
+}
+
+func enableHardwareTimestamping(iface string) error {
+	return &socketOptionError{"SIOCSHWTSTAMP on " + iface, errSocketOptionUnsupported}
+}
+
+func parseTimestamping(data []byte) (int64, string) {
+	return 0, ""
+}
+
+func readTxTimestamps(rawConn syscall.RawConn, oob []byte,
+	fn func(key uint32, timestamp int64, source string)) error {
+
+	return errSocketOptionUnsupported
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTimestampSourceUse(t *testing.T) {
+	var s timestampSource
+	for _, step := range []struct {
+		source     string
+		use, reset bool
+	}{
+		{TimestampSoftware, true, false},
+		{TimestampSoftware, true, false},
+		{TimestampUser, false, false},
+		// A more precise source replaces the measurements made so far:
+		{TimestampHardware, true, true},
+		{TimestampSoftware, false, false},
+		{TimestampHardware, true, false},
+	} {
+		use, reset := s.Use(step.source)
+		if use != step.use || reset != step.reset {
+			t.Errorf("Expected a %s timestamp to give use %v, reset %v but got %v, %v",
+				step.source, step.use, step.reset, use, reset)
+		}
+	}
+	if s.name != TimestampHardware {
+		t.Errorf("Expected hardware timestamps to be used but got %s", s.name)
+	}
+}
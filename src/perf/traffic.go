@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Directions of the traffic of a run, relative to the agent that requested it.
+const (
+	// The requesting agent sends data to the target.
+	DirectionForward = "forward"
+
+	// The target sends data back to the requesting agent.
+	DirectionReverse = "reverse"
+
+	// Both directions at once.
+	DirectionBidirectional = "bidirectional"
+)
+
+// Validates a traffic direction, and applies the default (forward).
+func checkDirection(direction string) (string, error) {
+	switch direction {
+	case "":
+		return DirectionForward, nil
+	case DirectionForward, DirectionReverse, DirectionBidirectional:
+		return direction, nil
+	default:
+		return "", fmt.Errorf("Invalid traffic direction '%s'", direction)
+	}
+}
+
+// Parameters a traffic run sends to the remote sink when opening a connection or flow.
+type trafficParams struct {
+	RunId     string `json:runId`
+	Stream    int    `json:stream`
+	Direction string `json:direction`
+
+	// Traffic the sink sends back, in reverse and bidirectional modes.
+	MaxBytes        uint64 `json:maxBytes`
+	WriteSize       uint64 `json:writeSize`
+	WriteIntervalMs uint64 `json:writeIntervalMs`
+	EndTime         uint64 `json:endTime`
+
+	// Optional target rates of the reverse traffic.
+	RateBps          uint64 `json:rateBps`
+	PacketsPerSecond uint64 `json:packetsPerSecond`
+
+	// Optional TCP congestion control algorithm of the reverse traffic.
+	CongestionControl string `json:congestionControl`
+}
+
+// Whether the requesting agent sends data.
+func (p *trafficParams) Forward() bool {
+	return p.Direction != DirectionReverse
+}
+
+// Whether the sink sends data back.
+func (p *trafficParams) Reverse() bool {
+	return p.Direction == DirectionReverse || p.Direction == DirectionBidirectional
+}
+
+// -------------------------------------------------------------------------------------------------
+
+// Drives a stream of writes until a byte budget is reached or a context is done.
+type sendLoop struct {
+	// Describes the traffic in logs.
+	name string
+
+	// Bounds the traffic: cancelled on stop requests, with a deadline at the end time if any.
+	ctx context.Context
+
+	// Optional limit on the number of bytes to send.
+	maxBytes uint64
+
+	// Size of the writes, and smallest size of the last write when limited by maxBytes.
+	writeSize    uint64
+	minWriteSize uint64
+
+	// Optional time interval between writes.
+	writeInterval time.Duration
+
+	// Optional pacing of the writes to a target rate.
+	pacer *pacer
+
+	// Sends one buffer.
+	write func(buffer []byte) (int, error)
+
+	// Optional: sends the buffers write queued, before the loop sleeps until the next write,
+	// so that they do not wait in the queue.
+	flush func() error
+}
+
+// Runs the loop and returns the number of bytes sent, and the error that interrupted it if any.
+// Writes interrupted because the context is done are not reported as errors.
+func (l *sendLoop) Run() (uint64, error) {
+	var data = make([]byte, l.writeSize)
+	var sent uint64
+	var lastSendTime time.Time
+	for {
+		if l.done() {
+			return sent, nil
+		}
+		if (l.maxBytes > 0) && (sent >= l.maxBytes) {
+			glog.Infof("%s completed (max bytes reached)", l.name)
+			return sent, nil
+		}
+
+		if l.writeInterval > 0 {
+			var sleepTime = l.writeInterval - time.Since(lastSendTime)
+			if err := l.flushQueued(); err != nil {
+				return sent, err
+			}
+			if !sleepContext(l.ctx, sleepTime-time.Duration(1)*time.Millisecond) {
+				continue
+			}
+		}
+		var buffer = data[0:l.writeSize]
+		if l.maxBytes > 0 {
+			buffer = buffer[0:max(l.minWriteSize, min(l.writeSize, l.maxBytes-sent))]
+		}
+		if l.pacer != nil {
+			allowed := l.pacer.reserve(time.Now(), len(buffer))
+			if l.pacer.sleeps(allowed) {
+				if err := l.flushQueued(); err != nil {
+					return sent, err
+				}
+			}
+			if !l.pacer.waitUntil(l.ctx, allowed) {
+				continue
+			}
+		}
+		lastSendTime = time.Now()
+		nbytes, err := l.write(buffer)
+		sent += uint64(nbytes)
+		if err != nil {
+			if l.done() {
+				return sent, nil
+			}
+			return sent, err
+		}
+		glog.V(1).Infof("Sent %d bytes (%d out of %d bytes) for %s",
+			nbytes, sent, l.maxBytes, l.name)
+	}
+}
+
+// Sends the queued buffers if any. Errors once the loop is done are not reported.
+func (l *sendLoop) flushQueued() error {
+	if l.flush == nil {
+		return nil
+	}
+	if err := l.flush(); err != nil && !l.done() {
+		return err
+	}
+	return nil
+}
+
+func (l *sendLoop) done() bool {
+	return trafficDone(l.ctx, l.name)
+}
+
+// Reports whether the context bounding some traffic is done, and logs why.
+func trafficDone(ctx context.Context, name string) bool {
+	switch ctx.Err() {
+	case nil:
+		return false
+	case context.DeadlineExceeded:
+		glog.Infof("%s completed (time is over)", name)
+	default:
+		glog.Infof("Stopping %s", name)
+	}
+	return true
+}
+
+// Builds the loop for the traffic a sink sends back to a traffic run.
+func newReverseSendLoop(ctx context.Context, name string, params *trafficParams) *sendLoop {
+	loop := &sendLoop{
+		name:          name,
+		ctx:           ctx,
+		maxBytes:      params.MaxBytes,
+		writeSize:     params.WriteSize,
+		writeInterval: time.Duration(params.WriteIntervalMs) * time.Millisecond,
+		pacer:         newPacer(params.RateBps, params.PacketsPerSecond),
+	}
+	if loop.writeSize == 0 {
+		loop.writeSize = 1024
+	}
+	return loop
+}
+
+// Derives the context bounding the reverse traffic a sink sends.
+func (p *trafficParams) withEndTime(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withEndTime(ctx, p.EndTime > 0, time.Unix(int64(p.EndTime), 0))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSendLoopFlushBeforeSleeping(t *testing.T) {
+	// 6 writes at 100 packets per second, queued until flushed:
+	var queued, maxQueued uint64
+	var flushes int
+	loop := &sendLoop{
+		name:      "test traffic",
+		ctx:       context.Background(),
+		maxBytes:  600,
+		writeSize: 100,
+		pacer:     newPacer(0, 100),
+		write: func(buffer []byte) (int, error) {
+			queued += 1
+			return len(buffer), nil
+		},
+		flush: func() error {
+			maxQueued = max(maxQueued, queued)
+			queued = 0
+			flushes += 1
+			return nil
+		},
+	}
+	if sent, err := loop.Run(); sent != 600 || err != nil {
+		t.Fatalf("Expected 600 bytes sent but got %d (error %v)", sent, err)
+	}
+	// Only the writes allowed by the burst credit are sent without waiting:
+	if flushes < 4 || maxQueued > 2 {
+		t.Errorf("Expected the writes to be flushed before each wait, but got %d flushes of up "+
+			"to %d writes", flushes, maxQueued)
+	}
+}
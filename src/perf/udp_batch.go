@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Paths used by UDP traffic runs to hand their datagrams to the kernel.
+const (
+	// One write system call per datagram.
+	UdpSendWrite = "write"
+
+	// Batches of datagrams sent with one sendmmsg system call.
+	UdpSendMmsg = "sendmmsg"
+
+	// Batches of datagrams written as one buffer, which the kernel or the network interface
+	// splits into datagrams (UDP generic segmentation offload, through UDP_SEGMENT).
+	UdpSendGso = "gso"
+)
+
+// Largest number of datagrams a UDP traffic run may send at once.
+const maxUdpBatchSize = 1024
+
+// The kernel splits a GSO buffer into at most 64 datagrams, and the buffer must fit in an IP
+// packet before segmentation.
+const (
+	udpGsoMaxSegments = 64
+	udpGsoMaxBytes    = 65000
+)
+
+// Reads and writes batches of datagrams, with recvmmsg and sendmmsg on Linux and one datagram
+// at a time elsewhere.
+type udpBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newUdpBatchConn(conn *net.UDPConn) udpBatchConn {
+	if conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+func checkUdpBatchSize(size uint64) error {
+	if size > maxUdpBatchSize {
+		return fmt.Errorf("Invalid batch size %d, must be at most %d", size, maxUdpBatchSize)
+	}
+	return nil
+}
+
+// Queues the datagrams of a UDP traffic run on a connected socket, and sends them in batches
+// through the best path available: GSO, then sendmmsg, then one write per datagram.
+type udpBatchSender struct {
+	name string
+	conn *net.UDPConn
+	path string
+
+	// Largest number of datagrams per batch.
+	batchSize int
+
+	// Datagrams queued for the next batch.
+	count int
+
+	// With GSO, the queued datagrams back to back: all of the segment size but the last.
+	buffer      []byte
+	segmentSize int
+
+	// With sendmmsg, the queued datagrams, each in its own buffer.
+	batchConn udpBatchConn
+	messages  []ipv4.Message
+
+	// Called with the number of datagrams and of bytes of every batch sent.
+	sent func(packets int, nbytes int)
+
+	// Optionally called for every write to the socket, in order, with the first datagram
+	// written.
+	onSend func(datagram []byte)
+}
+
+func newUdpBatchSender(name string, conn *net.UDPConn, batchSize int, datagramSize int,
+	sent func(packets int, nbytes int)) *udpBatchSender {
+
+	s := &udpBatchSender{name: name, conn: conn, batchSize: batchSize, sent: sent}
+	gsoSegments := udpGsoMaxBytes / datagramSize
+	if gsoSegments > udpGsoMaxSegments {
+		gsoSegments = udpGsoMaxSegments
+	}
+	if gsoSegments > batchSize {
+		gsoSegments = batchSize
+	}
+	if gsoSegments > 1 {
+		err := setUdpSegment(conn, datagramSize)
+		if err == nil {
+			s.path = UdpSendGso
+			s.batchSize = gsoSegments
+			s.segmentSize = datagramSize
+			s.buffer = make([]byte, 0, gsoSegments*datagramSize)
+			return s
+		}
+		glog.Infof("Not using GSO for %s: %s", name, err)
+	}
+	s.useSendmmsg(datagramSize)
+	return s
+}
+
+func (s *udpBatchSender) useSendmmsg(datagramSize int) {
+	if !udpSendmmsgSupported {
+		s.path = UdpSendWrite
+		return
+	}
+	s.path = UdpSendMmsg
+	s.batchConn = newUdpBatchConn(s.conn)
+	s.messages = make([]ipv4.Message, s.batchSize)
+	for i := range s.messages {
+		s.messages[i].Buffers = [][]byte{make([]byte, datagramSize)}
+	}
+}
+
+// Queues a datagram, and sends the batch once full.
+func (s *udpBatchSender) Queue(datagram []byte) error {
+	switch s.path {
+	case UdpSendGso:
+		// Only the last datagram of a GSO buffer may be shorter than the others:
+		if s.count > 0 && len(datagram) > s.segmentSize {
+			if err := s.Flush(); err != nil {
+				return err
+			}
+		}
+		s.buffer = append(s.buffer, datagram...)
+		s.count += 1
+		if s.count == s.batchSize || len(datagram) < s.segmentSize {
+			return s.Flush()
+		}
+	case UdpSendMmsg:
+		message := &s.messages[s.count]
+		message.Buffers[0] = append(message.Buffers[0][:0], datagram...)
+		s.count += 1
+		if s.count == s.batchSize {
+			return s.Flush()
+		}
+	default:
+		nbytes, err := s.conn.Write(datagram)
+		if err != nil {
+			return err
+		}
+		if s.onSend != nil {
+			s.onSend(datagram)
+		}
+		s.sent(1, nbytes)
+	}
+	return nil
+}
+
+// Sends the queued datagrams.
+func (s *udpBatchSender) Flush() error {
+	if s.count == 0 {
+		return nil
+	}
+	switch s.path {
+	case UdpSendGso:
+		nbytes, err := s.conn.Write(s.buffer)
+		if errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINVAL) {
+			// The network interface cannot segment the datagrams (EIO), or the segments do not
+			// fit its MTU (EINVAL):
+			glog.Warningf("GSO not supported for %s, falling back: %s", s.name, err)
+			return s.fallBackFromGso()
+		}
+		if err != nil {
+			return err
+		}
+		if s.onSend != nil {
+			s.onSend(s.buffer)
+		}
+		s.sent(s.count, nbytes)
+		s.buffer = s.buffer[:0]
+	case UdpSendMmsg:
+		sent, nbytes := 0, 0
+		for sent < s.count {
+			n, err := s.batchConn.WriteBatch(s.messages[sent:s.count], 0)
+			for _, message := range s.messages[sent : sent+n] {
+				nbytes += message.N
+				if s.onSend != nil {
+					s.onSend(message.Buffers[0])
+				}
+			}
+			sent += n
+			if err != nil {
+				s.sent(sent, nbytes)
+				s.count = 0
+				return err
+			}
+		}
+		s.sent(sent, nbytes)
+	}
+	s.count = 0
+	return nil
+}
+
+// Switches to sendmmsg, and sends the datagrams queued for GSO that way.
+func (s *udpBatchSender) fallBackFromGso() error {
+	if err := setUdpSegment(s.conn, 0); err != nil {
+		return err
+	}
+	queued := s.buffer
+	s.count = 0
+	s.buffer = nil
+	s.useSendmmsg(s.segmentSize)
+	for len(queued) > 0 {
+		datagram := queued
+		if len(datagram) > s.segmentSize {
+			datagram = datagram[0:s.segmentSize]
+		}
+		queued = queued[len(datagram):]
+		if err := s.Queue(datagram); err != nil {
+			return err
+		}
+	}
+	return s.Flush()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Sums the receive buffer errors of the UDP sockets of the host, over IPv4 and IPv6: the
+// datagrams dropped because the receive buffer of their socket was full. Returns 0 if not
+// available, and logs why.
+func hostRcvbufErrors() uint64 {
+	var total uint64
+	for _, source := range []struct {
+		path  string
+		parse func(io.Reader) (uint64, error)
+	}{
+		{"/proc/net/snmp", parseSnmpRcvbufErrors},
+		{"/proc/net/snmp6", parseSnmp6RcvbufErrors},
+	} {
+		file, err := os.Open(source.path)
+		if err != nil {
+			glog.V(1).Infof("Error reading UDP receive buffer errors: %s", err)
+			continue
+		}
+		count, err := source.parse(file)
+		file.Close()
+		if err != nil {
+			glog.V(1).Infof("Error reading UDP receive buffer errors from %s: %s", source.path, err)
+			continue
+		}
+		total += count
+	}
+	return total
+}
+
+// How often the receive path samples the receive buffer errors of the host.
+const rcvbufErrorsSamplePeriod = time.Second
+
+var (
+	rcvbufErrorsSampler sync.Once
+	rcvbufErrorsSample  atomic.Uint64
+)
+
+// Returns the receive buffer errors of the host as of the last sample, so that the receive
+// path does not read /proc for each new flow. Starts sampling on the first call.
+func sampledHostRcvbufErrors() uint64 {
+	rcvbufErrorsSampler.Do(func() {
+		rcvbufErrorsSample.Store(hostRcvbufErrors())
+		go func() {
+			for range time.Tick(rcvbufErrorsSamplePeriod) {
+				rcvbufErrorsSample.Store(hostRcvbufErrors())
+			}
+		}()
+	})
+	return rcvbufErrorsSample.Load()
+}
+
+// Parses the RcvbufErrors counter of the Udp lines of /proc/net/snmp: a line of field names
+// followed by a line of values.
+func parseSnmpRcvbufErrors(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	var names []string
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "Udp:" {
+			continue
+		}
+		if names == nil {
+			names = fields
+			continue
+		}
+		for i, name := range names {
+			if name == "RcvbufErrors" && i < len(fields) {
+				return strconv.ParseUint(fields[i], 10, 64)
+			}
+		}
+		break
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no Udp RcvbufErrors counter")
+}
+
+// Parses the Udp6RcvbufErrors counter of /proc/net/snmp6: a counter name and value per line.
+func parseSnmp6RcvbufErrors(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "Udp6RcvbufErrors" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no Udp6RcvbufErrors counter")
+}
+
+// Increase of a counter between two readings, 0 if the second reading failed.
+func counterIncrease(start, end uint64) uint64 {
+	if end < start {
+		return 0
+	}
+	return end - start
+}
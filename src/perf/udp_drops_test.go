@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSnmpRcvbufErrors(t *testing.T) {
+	snmp := `Ip: Forwarding DefaultTTL InReceives
+Ip: 1 64 1234
+Udp: InDatagrams NoPorts InErrors OutDatagrams RcvbufErrors SndbufErrors InCsumErrors IgnoredMulti MemErrors
+Udp: 1000 2 17 900 15 0 0 0 0
+UdpLite: InDatagrams NoPorts InErrors OutDatagrams RcvbufErrors SndbufErrors InCsumErrors IgnoredMulti MemErrors
+UdpLite: 0 0 0 0 3 0 0 0 0
+`
+	if count, err := parseSnmpRcvbufErrors(strings.NewReader(snmp)); err != nil || count != 15 {
+		t.Errorf("Expected 15 receive buffer errors but got %d (%v)", count, err)
+	}
+	if _, err := parseSnmpRcvbufErrors(strings.NewReader("Ip: Forwarding\nIp: 1\n")); err == nil {
+		t.Errorf("Expected an error without Udp counters")
+	}
+}
+
+func TestParseSnmp6RcvbufErrors(t *testing.T) {
+	snmp6 := `Udp6InDatagrams                 	120
+Udp6RcvbufErrors                	7
+UdpLite6RcvbufErrors            	2
+`
+	if count, err := parseSnmp6RcvbufErrors(strings.NewReader(snmp6)); err != nil || count != 7 {
+		t.Errorf("Expected 7 receive buffer errors but got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Sends the echo requests of a udp-echo latency probe to a UDP sink, and matches the replies.
+type udpEchoClient struct {
+	echoRequests
+
+	// ID of the probe, carried by the requests.
+	id   string
+	conn *net.UDPConn
+}
+
+// Starts reading the replies received on the connection, until closed.
+func newUdpEchoClient(id string, conn *net.UDPConn) *udpEchoClient {
+	c := &udpEchoClient{id: id, conn: conn}
+	c.init()
+	go c.readReplies()
+	return c
+}
+
+func (c *udpEchoClient) readReplies() {
+	var buffer = make([]byte, udpHeaderSize(c.id))
+	var header udpHeader
+	for {
+		nbytes, err := c.conn.Read(buffer)
+		now := time.Now()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// E.g. ICMP port unreachable errors, when the target has no sink:
+			glog.V(1).Infof("Error reading UDP echo replies for probe '%s': %s", c.id, err)
+			continue
+		}
+		err = header.Decode(buffer[0:nbytes])
+		if err != nil || header.Kind != udpPacketEchoReply || header.RunId != c.id {
+			continue
+		}
+		c.Reply(header.Seq, echoReply{time: now})
+	}
+}
+
+func (c *udpEchoClient) RoundTrip(timeout time.Duration) (
+	time.Time, time.Duration, int, error) {
+
+	seq, reply := c.Add()
+	header := udpHeader{Kind: udpPacketEcho, Seq: seq, RunId: c.id}
+	buffer := make([]byte, udpHeaderSize(c.id))
+	startTime := time.Now()
+	header.SendTime = startTime.UnixNano()
+	header.Encode(buffer)
+	if _, err := c.conn.Write(buffer); err != nil {
+		c.Forget(header.Seq, false)
+		return time.Time{}, 0, 0, err
+	}
+	rtt, ttl, err := c.Wait(header.Seq, reply, startTime, timeout)
+	return startTime, rtt, ttl, err
+}
+
+func (c *udpEchoClient) Close() error {
+	return c.conn.Close()
+}
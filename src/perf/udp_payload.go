@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// Header carried at the beginning of every datagram sent by a UDP traffic run:
+//
+//	 0: magic number (uint32)
+//	 4: packet kind (uint16)
+//	 6: length of the run ID (uint16)
+//	 8: sequence number (uint64)
+//	16: send time, in UNIX nanoseconds (int64)
+//	24: run ID
+//
+// All integers are encoded in network byte order.
+type udpHeader struct {
+	Kind     uint16
+	Seq      uint64
+	SendTime int64
+	RunId    string
+}
+
+const (
+	udpHeaderMagic     uint32 = 0x676e7075 // "gnpu"
+	udpHeaderFixedSize        = 24
+)
+
+// Kinds of packets.
+const (
+	udpPacketData uint16 = 0
+
+	// Asks the sink to send traffic back, with the traffic parameters following the header.
+	udpPacketStart uint16 = 1
+
+	// Marks the end of the traffic sent by a run or by a sink, with the number of data packets
+	// sent as sequence number. Also asks the sink to stop sending traffic back.
+	udpPacketStop uint16 = 2
+
+	// Asks the sink to send the datagram back, as an echo reply. The run ID is the probe ID.
+	udpPacketEcho      uint16 = 3
+	udpPacketEchoReply uint16 = 4
+
+	// Sent by a run receiving reverse traffic while it sends nothing else, so that the sink
+	// keeps sending.
+	udpPacketKeepalive uint16 = 5
+)
+
+// Number of times control packets are sent, to make up for packet loss.
+const udpControlRepeat = 3
+
+var errUdpHeader = errors.New("datagram does not carry a valid traffic header")
+
+// Size of the header for the given run ID.
+func udpHeaderSize(runId string) int {
+	return udpHeaderFixedSize + len(runId)
+}
+
+// Writes the header at the beginning of the buffer, and returns the number of bytes written.
+// The buffer must be at least udpHeaderSize(h.RunId) bytes long.
+func (h *udpHeader) Encode(buffer []byte) int {
+	binary.BigEndian.PutUint32(buffer[0:], udpHeaderMagic)
+	binary.BigEndian.PutUint16(buffer[4:], h.Kind)
+	binary.BigEndian.PutUint16(buffer[6:], uint16(len(h.RunId)))
+	binary.BigEndian.PutUint64(buffer[8:], h.Seq)
+	binary.BigEndian.PutUint64(buffer[16:], uint64(h.SendTime))
+	return udpHeaderFixedSize + copy(buffer[udpHeaderFixedSize:], h.RunId)
+}
+
+// Parses the header at the beginning of a datagram.
+func (h *udpHeader) Decode(data []byte) error {
+	if len(data) < udpHeaderFixedSize || binary.BigEndian.Uint32(data[0:]) != udpHeaderMagic {
+		return errUdpHeader
+	}
+	runIdLen := int(binary.BigEndian.Uint16(data[6:]))
+	if len(data) < udpHeaderFixedSize+runIdLen {
+		return errUdpHeader
+	}
+	h.Kind = binary.BigEndian.Uint16(data[4:])
+	h.Seq = binary.BigEndian.Uint64(data[8:])
+	h.SendTime = int64(binary.BigEndian.Uint64(data[16:]))
+	h.RunId = string(data[udpHeaderFixedSize : udpHeaderFixedSize+runIdLen])
+	return nil
+}
+
+// Sends a control packet, with optional traffic parameters.
+func sendUdpControl(write func([]byte) (int, error),
+	kind uint16, runId string, seq uint64, params *trafficParams) error {
+
+	var payload []byte
+	if params != nil {
+		var err error
+		if payload, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	header := udpHeader{Kind: kind, Seq: seq, RunId: runId}
+	buffer := make([]byte, udpHeaderSize(runId)+len(payload))
+	copy(buffer[header.Encode(buffer):], payload)
+	for i := 0; i < udpControlRepeat; i++ {
+		if _, err := write(buffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
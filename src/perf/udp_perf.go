@@ -1,51 +1,695 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"golang.org/x/net/ipv4"
 )
 
 var (
 	flagUdpReadBufferSize = flag.Uint64("udp-read-buffer-size", 16*1024,
 		"Size of the buffer used when reading UDP messages.")
+
+	flagUdpReceiverHistory = flag.Int("udp-receiver-history", 1000,
+		"Number of UDP flows to keep track of, shared evenly by the readers of the UDP service "+
+			"and the reverse traffic of the UDP runs: each keeps the most recent of its flows.")
+
+	flagUdpReaders = flag.Int("udp-readers", runtime.NumCPU(),
+		"Number of sockets reading UDP messages in parallel, sharing the port with SO_REUSEPORT.")
+
+	flagUdpBatchSize = flag.Int("udp-batch-size", 64,
+		"Number of UDP messages read at once by each reader.")
+
+	flagUdpTimestamping = flag.String("udp-timestamping", TimestampUser,
+		"Source of the receive times of UDP packets: user, software or hardware (SO_TIMESTAMPING).")
+
+	flagUdpTimestampingInterface = flag.String("udp-timestamping-interface", "",
+		"Network interface to configure for hardware timestamps of UDP packets "+
+			"(needs CAP_NET_ADMIN).")
+
+	flagUdpSocketOptions = flag.String("udp-socket-options", "",
+		"Socket options of the UDP service, as JSON (e.g. '{\"ReceiveBuffer\": 4194304}').")
+
+	flagUdpReverseMaxSenders = flag.Int("udp-reverse-max-senders", 16,
+		"Number of reverse UDP traffic flows the sink sends at most at once.")
+
+	flagUdpReverseMaxRate = flag.Uint64("udp-reverse-max-rate", 1000*1000*1000,
+		"Bit rate of every reverse UDP traffic flow the sink sends, at most.")
 )
 
-func handleUdpMessages(conn *net.UDPConn) {
+type UdpReceiverListReq struct {
+	// When set, only list the flows of the given traffic run.
+	RunId string `json:runId`
+}
+
+type UdpReceiverStatusReq struct {
+	Id string `json:id`
+}
+
+// Accounting for the datagrams received from one remote address for one traffic run.
+type UdpFlowStatus struct {
+	Id string `json:id`
+
+	// Empty for datagrams that do not carry a traffic header.
+	RunId string `json:runId`
+
+	RemoteAddr string `json:remoteAddr`
+	LocalAddr  string `json:localAddr`
+
+	BytesReceived     uint64 `json:bytesReceived`
+	PacketsReceived   uint64 `json:packetsReceived`
+	PacketsExpected   uint64 `json:packetsExpected`
+	PacketsLost       uint64 `json:packetsLost`
+	PacketsReordered  uint64 `json:packetsReordered`
+	PacketsDuplicated uint64 `json:packetsDuplicated`
+	PacketsLate       uint64 `json:packetsLate`
+
+	// Percentage of the expected packets that were lost.
+	LossPercent float64 `json:lossPercent`
+
+	// In UNIX nanoseconds
+	FirstPacketTime int64 `json:firstPacketTime`
+	LastPacketTime  int64 `json:lastPacketTime`
+
+	// In bytes per second
+	AverageGoodput float64 `json:averageGoodput`
+
+	// Traffic sent back to the remote address, in reverse and bidirectional modes.
+	BytesSent   uint64 `json:bytesSent`
+	PacketsSent uint64 `json:packetsSent`
+
+	// Interarrival jitter as defined by RFC 3550, in nanoseconds.
+	JitterNs float64 `json:jitterNs`
+
+	// Largest one-way delay variation, relative to the smallest one-way delay, in nanoseconds.
+	MaxDelayVariationNs int64 `json:maxDelayVariationNs`
+
+	// Distributions of the one-way delay variations and of the times between consecutive
+	// packets, in microseconds.
+	DelayVariationUs *histogram `json:delayVariationUs`
+	InterArrivalUs   *histogram `json:interArrivalUs`
+
+	// Number of datagrams received with each DSCP value, when available.
+	DscpCounts map[int]uint64 `json:dscpCounts`
+
+	// Datagrams the sink dropped because the receive buffer of its socket was full, counted in
+	// the packets lost (SO_RXQ_OVFL). The socket reports drops on the next datagram it receives:
+	// they are attributed to its flow, even if they belong to another flow of the same socket.
+	ReceiveBufferDrops uint64 `json:receiveBufferDrops`
+
+	// Increase of the receive buffer errors of all the UDP sockets of the host while the flow
+	// was active (RcvbufErrors in /proc/net/snmp and /proc/net/snmp6), when available. The
+	// counter is sampled every second when the flow starts and finishes.
+	HostRcvbufErrors uint64 `json:hostRcvbufErrors`
+
+	// Number of datagrams whose receive time came from each timestamp source: user, software
+	// or hardware. The sources may use different clocks, so the jitter, delay variations and
+	// inter-arrival times only use the most precise source received, which replaces the
+	// measurements made with the others.
+	ReceiveTimestampSources map[string]uint64 `json:receiveTimestampSources`
+
+	// Timestamp source of the receive times used for the delay measurements.
+	DelayTimestampSource string `json:delayTimestampSource`
+}
+
+// What the agent knows about a received datagram, besides its payload.
+type udpPacketInfo struct {
+	// Receive time, in UNIX nanoseconds, and its source
+	time       int64
+	timeSource string
+
+	// -1 when unknown.
+	dscp int
+
+	// Datagrams the socket dropped before this one because its receive buffer was full.
+	drops uint64
+}
+
+// Information on a datagram received at the given time, to complete from its control messages.
+func newUdpPacketInfo(now time.Time) udpPacketInfo {
+	return udpPacketInfo{time: now.UnixNano(), timeSource: TimestampUser, dscp: -1}
+}
+
+type udpFlow struct {
+	status UdpFlowStatus
+	seq    seqTracker
+	delay  *delayTracker
+
+	// Source of the receive times of the delay measurements.
+	delaySource timestampSource
+
+	// Receive buffer errors of the host when the flow started, and when it finished.
+	rcvbufErrorsStart uint64
+	rcvbufErrorsEnd   uint64
+	finished          bool
+}
+
+// Hardware timestamps may not come from the system clock: the first and last packet times
+// of the flow are taken in user space.
+func (f *udpFlow) addPacket(now time.Time, nbytes int, header *udpHeader, info *udpPacketInfo) {
+	if f.status.FirstPacketTime == 0 {
+		f.status.FirstPacketTime = now.UnixNano()
+	}
+	f.status.LastPacketTime = now.UnixNano()
+	f.status.BytesReceived += uint64(nbytes)
+	f.status.PacketsReceived += 1
+	if header != nil {
+		f.seq.Add(header.Seq)
+		use, reset := f.delaySource.Use(info.timeSource)
+		if reset {
+			f.delay = newDelayTracker()
+		}
+		if use {
+			f.delay.Add(header.SendTime, info.time)
+		}
+	}
+	if info.dscp >= 0 {
+		if f.status.DscpCounts == nil {
+			f.status.DscpCounts = make(map[int]uint64)
+		}
+		f.status.DscpCounts[info.dscp] += 1
+	}
+	if f.status.ReceiveTimestampSources == nil {
+		f.status.ReceiveTimestampSources = make(map[string]uint64)
+	}
+	f.status.ReceiveTimestampSources[info.timeSource] += 1
+	f.status.ReceiveBufferDrops += info.drops
+}
+
+// Given the current receive buffer errors of the host, read without holding the shard lock.
+func (f *udpFlow) Snapshot(rcvbufErrors uint64) UdpFlowStatus {
+	status := f.status
+	status.PacketsExpected = f.seq.Expected()
+	status.PacketsLost = f.seq.Lost
+	status.PacketsReordered = f.seq.Reordered
+	status.PacketsDuplicated = f.seq.Duplicates
+	status.PacketsLate = f.seq.Late
+	status.LossPercent = f.seq.LossPercent()
+	status.AverageGoodput =
+		averageRate(status.BytesReceived, status.FirstPacketTime, status.LastPacketTime)
+	status.DelayTimestampSource = f.delaySource.name
+	status.JitterNs = f.delay.Jitter()
+	status.MaxDelayVariationNs = f.delay.MaxDelayVariation()
+	status.DelayVariationUs = f.delay.delayVariations.Copy()
+	status.InterArrivalUs = f.delay.interArrivals.Copy()
+	status.DscpCounts = make(map[int]uint64, len(f.status.DscpCounts))
+	for dscp, count := range f.status.DscpCounts {
+		status.DscpCounts[dscp] = count
+	}
+	status.ReceiveTimestampSources = make(map[string]uint64, len(f.status.ReceiveTimestampSources))
+	for source, count := range f.status.ReceiveTimestampSources {
+		status.ReceiveTimestampSources[source] = count
+	}
+	rcvbufErrorsEnd := f.rcvbufErrorsEnd
+	if !f.finished {
+		rcvbufErrorsEnd = rcvbufErrors
+	}
+	status.HostRcvbufErrors = counterIncrease(f.rcvbufErrorsStart, rcvbufErrorsEnd)
+	return status
+}
+
+// Flows received by one reader socket of the UDP sink, or by the traffic runs of this agent.
+// With SO_REUSEPORT, the datagrams of a flow all reach the same socket: each reader owns the
+// flows it receives, so that readers do not contend on a shared lock.
+type udpFlowShard struct {
+	mutex    sync.Mutex
+	registry *udpFlowRegistry
+
+	// Flows indexed by ID, and by remote address and run ID.
+	flows    map[string]*udpFlow
+	flowKeys map[string]*udpFlow
+
+	// Drop counter of the reader socket, as of the last drops attributed to a flow.
+	drops uint32
+}
+
+// Registry of the flows received by the UDP sink and by the traffic runs, over all the shards.
+type udpFlowRegistry struct {
+	mutex  sync.Mutex
+	shards []*udpFlowShard
+
+	// Number of flows ever created, to assign IDs.
+	count atomic.Uint64
+
+	// Number of shards, among which the history of flows is divided.
+	shardCount atomic.Int64
+}
+
+var udpFlows = &udpFlowRegistry{}
+
+// Flows of the reverse traffic received by the traffic runs.
+var udpRunFlows = udpFlows.NewShard()
+
+func udpFlowKey(remoteAddr, runId string) string {
+	return remoteAddr + "/" + runId
+}
+
+func (r *udpFlowRegistry) NewShard() *udpFlowShard {
+	shard := &udpFlowShard{
+		registry: r,
+		flows:    make(map[string]*udpFlow),
+		flowKeys: make(map[string]*udpFlow),
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.shards = append(r.shards, shard)
+	r.shardCount.Store(int64(len(r.shards)))
+	return shard
+}
+
+// Accounts for a datagram received from the given remote address, and returns the flow ID.
+// The header is nil for datagrams that do not carry a traffic header.
+func (s *udpFlowShard) AddPacket(remoteAddr, localAddr string, nbytes int, header *udpHeader,
+	info *udpPacketInfo) string {
+
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.addPacketLocked(now, remoteAddr, localAddr, nbytes, header, info)
+}
+
+func (s *udpFlowShard) addPacketLocked(now time.Time, remoteAddr, localAddr string, nbytes int,
+	header *udpHeader, info *udpPacketInfo) string {
+
+	var runId string
+	if header != nil {
+		runId = header.RunId
+	}
+	flow := s.getOrCreate(remoteAddr, localAddr, runId)
+	flow.addPacket(now, nbytes, header, info)
+	return flow.status.Id
+}
+
+// Accounts for a datagram sent back to the given remote address for a traffic run.
+func (s *udpFlowShard) AddSent(remoteAddr, localAddr, runId string, nbytes int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	flow := s.getOrCreate(remoteAddr, localAddr, runId)
+	flow.status.BytesSent += uint64(nbytes)
+	flow.status.PacketsSent += 1
+}
+
+// Accounts for the end of the traffic of a run, after total packets were sent.
+func (s *udpFlowShard) Finish(remoteAddr, runId string, total uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.finishLocked(remoteAddr, runId, total, 0)
+}
+
+// Also accounts for the datagrams the socket dropped before the end of the traffic.
+func (s *udpFlowShard) finishLocked(remoteAddr, runId string, total uint64, drops uint64) {
+	if flow, ok := s.flowKeys[udpFlowKey(remoteAddr, runId)]; ok {
+		flow.seq.Finish(total)
+		flow.status.ReceiveBufferDrops += drops
+		if !flow.finished {
+			flow.rcvbufErrorsEnd = sampledHostRcvbufErrors()
+			flow.finished = true
+		}
+	}
+}
+
+// Returns the datagrams the reader socket dropped since the last call, given its drop counter.
+func (s *udpFlowShard) takeDrops(counter uint32) uint64 {
+	drops := counter - s.drops
+	s.drops = counter
+	return uint64(drops)
+}
+
+func (s *udpFlowShard) getOrCreate(remoteAddr, localAddr, runId string) *udpFlow {
+	key := udpFlowKey(remoteAddr, runId)
+	flow, ok := s.flowKeys[key]
+	if !ok {
+		flow = s.newFlow(remoteAddr, localAddr, runId)
+		s.flowKeys[key] = flow
+	}
+	return flow
+}
+
+func (s *udpFlowShard) newFlow(remoteAddr, localAddr, runId string) *udpFlow {
+	for len(s.flows) > 0 && len(s.flows) >= s.history() {
+		s.evictOldest()
+	}
+	flow := &udpFlow{delay: newDelayTracker(), rcvbufErrorsStart: sampledHostRcvbufErrors()}
+	flow.status.Id = fmt.Sprintf("%s-flow-%d", serverId, s.registry.count.Add(1)-1)
+	flow.status.RunId = runId
+	flow.status.RemoteAddr = remoteAddr
+	flow.status.LocalAddr = localAddr
+	s.flows[flow.status.Id] = flow
+	glog.Infof("New UDP flow '%s' for run '%s' from %s\n", flow.status.Id, runId, remoteAddr)
+	return flow
+}
+
+// Number of flows the shard keeps: its share of the history, so that the shards do not have
+// to evict the flows of one another.
+func (s *udpFlowShard) history() int {
+	history := *flagUdpReceiverHistory / int(s.registry.shardCount.Load())
+	if history < 1 {
+		history = 1
+	}
+	return history
+}
+
+// Forgets about the flow that has been idle for the longest time.
+func (s *udpFlowShard) evictOldest() {
+	var oldest *udpFlow
+	for _, flow := range s.flows {
+		if oldest == nil || flow.status.LastPacketTime < oldest.status.LastPacketTime {
+			oldest = flow
+		}
+	}
+	delete(s.flows, oldest.status.Id)
+	delete(s.flowKeys, udpFlowKey(oldest.status.RemoteAddr, oldest.status.RunId))
+}
+
+func (r *udpFlowRegistry) getShards() []*udpFlowShard {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.shards
+}
+
+func (r *udpFlowRegistry) Get(id string) (UdpFlowStatus, bool) {
+	rcvbufErrors := hostRcvbufErrors()
+	for _, shard := range r.getShards() {
+		shard.mutex.Lock()
+		flow, ok := shard.flows[id]
+		if ok {
+			status := flow.Snapshot(rcvbufErrors)
+			shard.mutex.Unlock()
+			return status, true
+		}
+		shard.mutex.Unlock()
+	}
+	return UdpFlowStatus{}, false
+}
+
+// Lists the flows in the order they were first seen.
+func (r *udpFlowRegistry) List(runId string) []UdpFlowStatus {
+	statuses := make([]UdpFlowStatus, 0)
+	rcvbufErrors := hostRcvbufErrors()
+	for _, shard := range r.getShards() {
+		shard.mutex.Lock()
+		for _, flow := range shard.flows {
+			if runId != "" && flow.status.RunId != runId {
+				continue
+			}
+			statuses = append(statuses, flow.Snapshot(rcvbufErrors))
+		}
+		shard.mutex.Unlock()
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].FirstPacketTime < statuses[j].FirstPacketTime
+	})
+	return statuses
+}
+
+// Reverse traffic sent by the sink to a traffic run.
+type udpReverseSender struct {
+	cancel context.CancelFunc
+
+	// Time of the latest packet received from the run, in UNIX nanoseconds.
+	lastSeen atomic.Int64
+}
+
+// Reverse traffic being sent by the sink, indexed by flow key, and number of senders, read
+// without the lock on the receive path.
+var (
+	udpReverseMutex   sync.Mutex
+	udpReverseSenders = make(map[string]*udpReverseSender)
+	udpReverseCount   atomic.Int64
+)
+
+// Starts sending the reverse traffic requested by a traffic run, unless already started.
+//
+// The request may come from a spoofed address: the traffic must be bounded in bytes or in time,
+// its rate is capped, and it stops once the run sends nothing for udpReverseIdleTimeout.
+func startUdpReverse(conn *net.UDPConn, shard *udpFlowShard, remoteAddr net.Addr, runId string,
+	payload []byte) {
+
+	params := &trafficParams{}
+	if err := json.Unmarshal(payload, params); err != nil {
+		glog.Errorf("Error decoding UDP traffic parameters from %s: %s\n", remoteAddr, err)
+		return
+	}
+	if !params.Reverse() {
+		return
+	}
+	if params.MaxBytes == 0 && params.EndTime == 0 {
+		glog.Warningf("Ignoring unbounded reverse UDP traffic request '%s' from %s",
+			runId, remoteAddr)
+		return
+	}
+	if params.RateBps == 0 || params.RateBps > *flagUdpReverseMaxRate {
+		params.RateBps = *flagUdpReverseMaxRate
+	}
+
+	key := udpFlowKey(remoteAddr.String(), runId)
+	udpReverseMutex.Lock()
+	defer udpReverseMutex.Unlock()
+	if _, exists := udpReverseSenders[key]; exists {
+		return
+	}
+	if len(udpReverseSenders) >= *flagUdpReverseMaxSenders {
+		glog.Warningf("Ignoring reverse UDP traffic request '%s' from %s: %d flows already sent",
+			runId, remoteAddr, len(udpReverseSenders))
+		return
+	}
+	ctx, cancel := params.withEndTime(context.Background())
+	sender := &udpReverseSender{cancel: cancel}
+	sender.lastSeen.Store(time.Now().UnixNano())
+	udpReverseSenders[key] = sender
+	udpReverseCount.Add(1)
+
+	go sender.stopWhenIdle(ctx, fmt.Sprintf("reverse UDP traffic for run '%s' to %s",
+		runId, remoteAddr))
+	go func() {
+		sendUdpReverse(ctx, conn, shard, remoteAddr, runId, params)
+		udpReverseMutex.Lock()
+		delete(udpReverseSenders, key)
+		udpReverseCount.Add(-1)
+		udpReverseMutex.Unlock()
+		cancel()
+	}()
+}
+
+// Stops the traffic once the run sends nothing for udpReverseIdleTimeout, e.g. after it
+// crashed, or when all its stop packets got lost.
+func (s *udpReverseSender) stopWhenIdle(ctx context.Context, name string) {
+	ticker := time.NewTicker(udpReverseIdleTimeout / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, s.lastSeen.Load())) > udpReverseIdleTimeout {
+				glog.Infof("Stopping %s: nothing received from the run for %s", name,
+					udpReverseIdleTimeout)
+				s.cancel()
+				return
+			}
+		}
+	}
+}
+
+func stopUdpReverse(remoteAddr net.Addr, runId string) {
+	udpReverseMutex.Lock()
+	defer udpReverseMutex.Unlock()
+	if sender, exists := udpReverseSenders[udpFlowKey(remoteAddr.String(), runId)]; exists {
+		sender.cancel()
+	}
+}
+
+// Records a packet received from a traffic run, which keeps its reverse traffic going.
+func touchUdpReverse(raddr string, runId string, now time.Time) {
+	if udpReverseCount.Load() == 0 {
+		return
+	}
+	udpReverseMutex.Lock()
+	defer udpReverseMutex.Unlock()
+	if sender, exists := udpReverseSenders[udpFlowKey(raddr, runId)]; exists {
+		sender.lastSeen.Store(now.UnixNano())
+	}
+}
+
+func sendUdpReverse(ctx context.Context, conn *net.UDPConn, shard *udpFlowShard,
+	remoteAddr net.Addr, runId string, params *trafficParams) {
+
+	var raddr = remoteAddr.String()
+	var localAddr = conn.LocalAddr().String()
+	headerSize := uint64(udpHeaderSize(runId))
+	loop := newReverseSendLoop(
+		ctx, fmt.Sprintf("reverse UDP traffic for run '%s' to %s", runId, raddr), params)
+	loop.writeSize = max(loop.writeSize, headerSize)
+	loop.minWriteSize = headerSize
+
+	var header = udpHeader{Kind: udpPacketData, RunId: runId}
+	loop.write = func(buffer []byte) (int, error) {
+		header.SendTime = time.Now().UnixNano()
+		header.Encode(buffer)
+		nbytes, err := conn.WriteTo(buffer, remoteAddr)
+		if err != nil {
+			return 0, err
+		}
+		header.Seq += 1
+		shard.AddSent(raddr, localAddr, runId, nbytes)
+		return nbytes, nil
+	}
+	if _, err := loop.Run(); err != nil {
+		glog.Errorf("Error sending reverse UDP traffic to %s: %s\n", raddr, err)
+	}
+
+	write := func(buffer []byte) (int, error) { return conn.WriteTo(buffer, remoteAddr) }
+	sendUdpControl(write, udpPacketStop, runId, header.Seq, nil)
+}
+
+// Reads the datagrams received by one reader socket in batches, and accounts for them in the
+// flows of the given shard.
+func handleUdpMessages(conn *net.UDPConn, shard *udpFlowShard) {
 	defer conn.Close()
-	var buffer = make([]byte, *flagUdpReadBufferSize)
+	var localAddr = conn.LocalAddr().String()
+	var reader = newUdpBatchConn(conn)
 
-	var totals = make(map[string]uint64)
-	var totalBytes = uint64(0)
+	var messages = make([]ipv4.Message, *flagUdpBatchSize)
+	for i := range messages {
+		messages[i].Buffers = [][]byte{make([]byte, *flagUdpReadBufferSize)}
+		messages[i].OOB =
+			make([]byte, dscpControlSize+rxqOvflControlSize+timestampingControlSize)
+	}
+
+	var header udpHeader
 	for {
-		nbytes, remoteAddr, err := conn.ReadFrom(buffer)
-		if err == io.EOF {
+		count, err := reader.ReadBatch(messages, 0)
+		if errors.Is(err, net.ErrClosed) {
 			break
 		}
 		if err != nil {
 			glog.Fatal("Error reading from UDP socket:", err)
 		}
-		var raddr = remoteAddr.String()
-		total := totals[raddr]
-		total += uint64(nbytes)
-		totals[raddr] = total
-		glog.Infof("Received %d bytes over UDP from %s (total = %d)\n", nbytes, raddr, total)
-		totalBytes += uint64(nbytes)
+
+		now := time.Now()
+		shard.mutex.Lock()
+		for _, message := range messages[:count] {
+			var buffer = message.Buffers[0][0:message.N]
+			var raddr = message.Addr.String()
+			var info = newUdpPacketInfo(now)
+			var dropCounter = parseUdpControl(message.OOB[0:message.NN], &info)
+			if err := header.Decode(buffer); err != nil {
+				info.drops = shard.takeDrops(dropCounter)
+				shard.addPacketLocked(now, raddr, localAddr, message.N, nil, &info)
+				continue
+			}
+			switch header.Kind {
+			case udpPacketStart:
+				payload := buffer[udpHeaderSize(header.RunId):]
+				startUdpReverse(conn, shard, message.Addr, header.RunId, payload)
+			case udpPacketStop:
+				stopUdpReverse(message.Addr, header.RunId)
+				shard.finishLocked(raddr, header.RunId, header.Seq, shard.takeDrops(dropCounter))
+			case udpPacketEcho:
+				header.Kind = udpPacketEchoReply
+				header.Encode(buffer)
+				if _, err := conn.WriteTo(buffer, message.Addr); err != nil {
+					glog.V(1).Infof("Error sending UDP echo reply to %s: %s", raddr, err)
+				}
+			case udpPacketEchoReply:
+				// Not expected from a remote agent.
+			case udpPacketKeepalive:
+				touchUdpReverse(raddr, header.RunId, now)
+			default:
+				touchUdpReverse(raddr, header.RunId, now)
+				info.drops = shard.takeDrops(dropCounter)
+				shard.addPacketLocked(now, raddr, localAddr, message.N, &header, &info)
+			}
+		}
+		shard.mutex.Unlock()
 	}
 }
 
 func startUdpService(port int) {
-	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", port))
+	socketOptions, err := parseSocketOptions(*flagUdpSocketOptions)
+	if err == nil {
+		err = socketOptions.checkUdp()
+	}
+	if err != nil {
+		glog.Fatal(err)
+	}
+	if *flagUdpBatchSize < 1 {
+		glog.Fatalf("Invalid UDP batch size %d", *flagUdpBatchSize)
+	}
+	readers := *flagUdpReaders
+	if readers < 1 {
+		readers = 1
+	}
+	timestamping, err := checkTimestamping(*flagUdpTimestamping)
 	if err != nil {
-		glog.Fatal("Error resolving UDP address:", err)
+		glog.Fatal(err)
+	}
+	if timestamping == TimestampHardware && *flagUdpTimestampingInterface != "" {
+		if err := enableHardwareTimestamping(*flagUdpTimestampingInterface); err != nil {
+			glog.Warningf("Not configuring hardware timestamps: %s", err)
+		}
+	}
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, rawConn syscall.RawConn) error {
+			if readers > 1 {
+				if err := setReusePort(rawConn); err != nil {
+					glog.Warningf("Using a single UDP reader: %s", err)
+					readers = 1
+				}
+			}
+			if err := enableRecvTos(rawConn, network); err != nil {
+				glog.Warningf("Not reporting DSCP of UDP flows: %s", err)
+			}
+			if err := enableRxqOvfl(rawConn); err != nil {
+				glog.Warningf("Not reporting receive buffer drops of UDP flows: %s", err)
+			}
+			if timestamping != TimestampUser {
+				if err := enableTimestamping(rawConn, timestamping, false); err != nil {
+					glog.Warningf("Timestamping UDP packets in user space: %s", err)
+				}
+			}
+			return setSocketOptions(rawConn, socketOptions)
+		},
+	}
+
+	// Listens on both address families, with one socket per reader sharing the port:
+	address := fmt.Sprintf(":%d", port)
+	var conns []*net.UDPConn
+	for i := 0; i < readers; i++ {
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			glog.Fatal("Error setting up UDP service:", err)
+		}
+		conns = append(conns, conn.(*net.UDPConn))
 	}
-	if conn, err := net.ListenUDP("udp", addr); err != nil {
-		glog.Fatal("Error setting up UDP service:", err)
-	} else {
-		glog.Info("UDP service ready on local address:", conn.LocalAddr())
-		handleUdpMessages(conn)
+	glog.Infof("UDP service ready on local address %s with %d readers", conns[0].LocalAddr(),
+		len(conns))
+	if values := readSocketOptions(conns[0], false); values != nil {
+		glog.Infof("UDP service socket options: %+v", *values)
+	}
+
+	// Starts sampling before the first flow, rather than reading /proc under a shard lock:
+	sampledHostRcvbufErrors()
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			handleUdpMessages(conn, udpFlows.NewShard())
+		}(conn)
 	}
+	wg.Wait()
 }
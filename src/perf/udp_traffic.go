@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"net"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 )
 
+// Reverse traffic is considered over after this long without receiving any packet, by the run
+// as by the sink sending it.
+const udpReverseIdleTimeout = 5 * time.Second
+
+// Interval between the keepalives a run receiving reverse traffic sends to the sink.
+const udpReverseKeepaliveInterval = time.Second
+
 type UdpReq struct {
 	Target   string `json:target`
 	MaxBytes uint64 `json:maxBytes`
@@ -21,6 +32,49 @@ type UdpReq struct {
 
 	// Optional end time (unix Epoch time, in seconds)
 	EndTime uint64 `json:endTime`
+
+	// Direction of the traffic: forward (default), reverse or bidirectional.
+	// In reverse mode, the target sends MaxBytes back to the socket of the run.
+	Direction string `json:direction`
+
+	// Optional target rates of the traffic, in bits per second and in datagrams per second.
+	// When both are set, the lower of the two rates applies.
+	RateBps          uint64 `json:rateBps`
+	PacketsPerSecond uint64 `json:packetsPerSecond`
+
+	// Time interval in between the interval reports of the run (default 1 s).
+	ReportIntervalMs uint64 `json:reportIntervalMs`
+
+	// Optional socket options of the socket. Only buffers and pacing rate apply.
+	SocketOptions *SocketOptions `json:socketOptions`
+
+	// Optional DSCP value (0-63) marking the traffic sent by the run.
+	Dscp int `json:dscp`
+
+	// Optional address family of the target: ipv4 or ipv6. By default, whichever family
+	// the target resolves to first.
+	AddressFamily string `json:addressFamily`
+
+	// Optional local IP address and port the traffic leaves from, and network interface the
+	// socket is bound to (SO_BINDTODEVICE).
+	SourceAddress string `json:sourceAddress`
+	SourcePort    int    `json:sourcePort`
+	Interface     string `json:interface`
+
+	// Optional number of datagrams handed to the kernel at once, to reach higher packet rates.
+	// Batches are sent with UDP GSO where available, with sendmmsg otherwise, so datagrams
+	// leave in bursts of up to this size. A batch is sent early when the pacing would otherwise
+	// hold it, so that datagrams do not wait in it.
+	BatchSize uint64 `json:batchSize`
+
+	// Optional source of the timestamps of the datagrams sent and received: user (default),
+	// taken by the agent, or software or hardware, taken at the socket layer (SO_TIMESTAMPING).
+	// Hardware timestamps need the network interface to be configured for them, by the operator
+	// or with the --udp-timestamping-interface flag: traffic runs do not configure interfaces.
+	// Datagrams without hardware timestamps fall back to software ones, but the hardware clock
+	// may differ from the system clock: the delay measurements of a flow only use the most
+	// precise source it received, and count the datagrams of each source.
+	Timestamping string `json:timestamping`
 }
 
 type UdpStopReq struct {
@@ -31,47 +85,246 @@ type UdpStatusReq struct {
 	Id string `json:id`
 }
 
+// Traffic of a UDP run over one reporting interval.
+type UdpIntervalReport struct {
+	IntervalReport
+
+	PacketsSent     uint64 `json:packetsSent`
+	PacketsReceived uint64 `json:packetsReceived`
+}
+
 type UdpRun struct {
-	Id        string  `json:id`
-	BytesSent uint64  `json:bytesSent`
-	Req       *UdpReq `json:req`
-	StopReq   bool
+	Id            string  `json:id`
+	BytesSent     uint64  `json:bytesSent`
+	BytesReceived uint64  `json:bytesReceived`
+	Req           *UdpReq `json:req`
+
+	RunLifecycle
+
+	// Number of datagrams sent, also the sequence number of the next datagram.
+	PacketsSent     uint64 `json:packetsSent`
+	PacketsReceived uint64 `json:packetsReceived`
 
 	// In UNIX nanoseconds
 	TrafficStartTime int64 `json:trafficStartTime`
 	TrafficEndTime   int64 `json:trafficEndTime`
+
+	// Average rates since the traffic started, in bytes per second
+	SendRate    float64 `json:sendRate`
+	ReceiveRate float64 `json:receiveRate`
+
+	// Average rates of the paced traffic (sent, or received in reverse mode), in bits and in
+	// datagrams per second, and the ratio to the target rate that applies (the lower one).
+	// Only set when the run has a target rate.
+	AchievedRateBps          float64 `json:achievedRateBps`
+	AchievedPacketsPerSecond float64 `json:achievedPacketsPerSecond`
+	RateAccuracy             float64 `json:rateAccuracy`
+
+	// ID of the flow tracking the reverse traffic in /udp/receiver/status, if any.
+	ReverseFlowId string `json:reverseFlowId`
+
+	// Increase of the receive buffer errors of all the UDP sockets of this host while the
+	// traffic ran (RcvbufErrors in /proc/net/snmp and /proc/net/snmp6), when available. Drops
+	// of the forward traffic at the target are reported in /udp/receiver/status.
+	HostRcvbufErrors uint64 `json:hostRcvbufErrors`
+
+	// Address of the target, and its address family: ipv4 or ipv6.
+	RemoteAddr    string `json:remoteAddr`
+	AddressFamily string `json:addressFamily`
+
+	// Socket options in effect on the socket, when available.
+	SocketOptions *SocketOptionValues `json:socketOptions`
+
+	// How the datagrams are sent: write, sendmmsg or gso.
+	SendPath string `json:sendPath`
+
+	// With kernel timestamping, number of datagrams sent whose transmit timestamp came from
+	// each source, and distribution of the times from the user-space send time the datagrams
+	// carry to their transmit timestamp, in µs: the part of the one-way delays measured by the
+	// receiver spent in the sending host. The distribution only uses the most precise source.
+	SendTimestampSources map[string]uint64 `json:sendTimestampSources`
+	SendStackDelayUs     *histogram        `json:sendStackDelayUs`
+
+	// Traffic of the run over every reporting interval, oldest first.
+	Intervals []UdpIntervalReport `json:intervals`
+
+	// Guards the status of the run.
+	mutex *sync.Mutex
+
+	// Cancelled when the run is stopped.
+	ctx context.Context
+
+	// Interrupts the traffic in both directions, once started.
+	cancelTraffic context.CancelFunc
+
+	// Counters at the end of the last reported interval.
+	lastReport intervalCounters
+
+	// Time of the last packet sent and of the last packet received, in UNIX nanoseconds
+	lastSendTime    int64
+	lastReceiveTime int64
+
+	// Receive buffer errors of the host when the traffic started, and when it ended.
+	rcvbufErrorsStart uint64
+	rcvbufErrorsEnd   uint64
+
+	// Transmit timestamps of the datagrams sent, with kernel timestamping.
+	tx *txTimestamps
 }
 
 var (
-	udpRuns            = make(map[string]*UdpRun)
+	udpRuns            = newRunManager()
 	udpRunCount uint64 = 0
 )
 
-func NewUdpRun(req *UdpReq) *UdpRun {
+func NewUdpRun(req *UdpReq) (*UdpRun, error) {
 	if req.WriteSize == 0 {
 		req.WriteSize = 1024
 	}
+	direction, err := checkDirection(req.Direction)
+	if err != nil {
+		return nil, err
+	}
+	req.Direction = direction
+	if direction != DirectionForward && req.MaxBytes == 0 && req.EndTime == 0 {
+		return nil, fmt.Errorf("Reverse UDP traffic must be bounded by maxBytes or endTime")
+	}
+	if req.ReportIntervalMs, err = checkReportInterval(req.ReportIntervalMs); err != nil {
+		return nil, err
+	}
+	if req.SocketOptions != nil {
+		if err := req.SocketOptions.checkUdp(); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkDscp(req.Dscp); err != nil {
+		return nil, err
+	}
+	if err := checkAddressFamily(req.AddressFamily); err != nil {
+		return nil, err
+	}
+	if err := checkSource(req.SourceAddress, req.SourcePort); err != nil {
+		return nil, err
+	}
+	if err := checkUdpBatchSize(req.BatchSize); err != nil {
+		return nil, err
+	}
+	if req.Timestamping, err = checkTimestamping(req.Timestamping); err != nil {
+		return nil, err
+	}
 
-	run := &UdpRun{}
+	run := &UdpRun{RunLifecycle: newRunLifecycle(), mutex: &sync.Mutex{}}
 	runId := atomic.AddUint64(&udpRunCount, 1) - 1
 	run.Id = fmt.Sprintf("%s-%d", serverId, runId)
 	run.Req = req
 
-	udpRuns[run.Id] = run
-	return run
+	run.ctx, _ = udpRuns.Add(run.Id, run)
+	return run, nil
 }
 
-func (run *UdpRun) Stop() {
-	run.StopReq = true
+// Returns a copy of the run status, safe to serialize while the run goes on.
+func (run *UdpRun) Snapshot() *UdpRun {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	snapshot := *run
+	snapshot.RunLifecycle = run.RunLifecycle.copy()
+	snapshot.Intervals = append([]UdpIntervalReport(nil), run.Intervals...)
+	if run.SendTimestampSources != nil {
+		snapshot.SendTimestampSources = make(map[string]uint64, len(run.SendTimestampSources))
+		for source, count := range run.SendTimestampSources {
+			snapshot.SendTimestampSources[source] = count
+		}
+		snapshot.SendStackDelayUs = run.SendStackDelayUs.Copy()
+	}
+	snapshot.SendRate = averageRate(run.BytesSent, run.TrafficStartTime, run.lastSendTime)
+	snapshot.ReceiveRate =
+		averageRate(run.BytesReceived, run.TrafficStartTime, run.lastReceiveTime)
+	if run.Req.RateBps > 0 || run.Req.PacketsPerSecond > 0 {
+		if run.Req.Direction == DirectionReverse {
+			snapshot.AchievedRateBps = snapshot.ReceiveRate * 8
+			snapshot.AchievedPacketsPerSecond = averageRate(
+				run.PacketsReceived, run.TrafficStartTime, run.lastReceiveTime)
+		} else {
+			snapshot.AchievedRateBps = snapshot.SendRate * 8
+			snapshot.AchievedPacketsPerSecond =
+				averageRate(run.PacketsSent, run.TrafficStartTime, run.lastSendTime)
+		}
+		snapshot.RateAccuracy = run.rateAccuracy(&snapshot)
+	}
+	if run.TrafficStartTime > 0 {
+		rcvbufErrorsEnd := run.rcvbufErrorsEnd
+		if run.TrafficEndTime == 0 {
+			rcvbufErrorsEnd = hostRcvbufErrors()
+		}
+		snapshot.HostRcvbufErrors = counterIncrease(run.rcvbufErrorsStart, rcvbufErrorsEnd)
+	}
+	return &snapshot
+}
+
+// Ratio of the achieved rate to the target rate that limits the traffic.
+func (run *UdpRun) rateAccuracy(status *UdpRun) float64 {
+	bitsAccuracy := status.AchievedRateBps / float64(run.Req.RateBps)
+	packetsAccuracy := status.AchievedPacketsPerSecond / float64(run.Req.PacketsPerSecond)
+	switch {
+	case run.Req.PacketsPerSecond == 0:
+		return bitsAccuracy
+	case run.Req.RateBps == 0:
+		return packetsAccuracy
+	default:
+		// The limiting target rate is the one the traffic got closest to:
+		return math.Max(bitsAccuracy, packetsAccuracy)
+	}
+}
+
+// Closes the current reporting interval, and starts the next one.
+func (run *UdpRun) reportInterval() {
+	now := time.Now().UnixNano()
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	counters := intervalCounters{
+		time:            now,
+		bytesSent:       run.BytesSent,
+		bytesReceived:   run.BytesReceived,
+		packetsSent:     run.PacketsSent,
+		packetsReceived: run.PacketsReceived,
+	}
+	if reportHistoryFull(len(run.Intervals)) {
+		run.Intervals = run.Intervals[1:]
+	}
+	run.Intervals = append(run.Intervals, UdpIntervalReport{
+		IntervalReport:  newIntervalReport(&run.lastReport, &counters),
+		PacketsSent:     counters.packetsSent - run.lastReport.packetsSent,
+		PacketsReceived: counters.packetsReceived - run.lastReport.packetsReceived,
+	})
+	run.lastReport = counters
 }
 
-func (run *UdpRun) waitForStartTime() {
+func (run *UdpRun) setState(state string) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.transition(state)
+}
+
+// Records the error that interrupted the run, and interrupts the traffic in both directions.
+func (run *UdpRun) abort(reason string, err error) {
+	run.mutex.Lock()
+	run.fail(reason, err)
+	cancel := run.cancelTraffic
+	run.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Waits for the start time of the run, if any. Returns false if the run is stopped first.
+func (run *UdpRun) waitForStartTime() bool {
 	if run.Req.StartTime > 0 {
 		startTime := time.Unix(int64(run.Req.StartTime), 0)
 		glog.Infof("UDP traffic '%s' beginning in %.03f seconds",
 			run.Id, startTime.Sub(time.Now()).Seconds())
-		time.Sleep(startTime.Sub(time.Now()))
+		return sleepContext(run.ctx, startTime.Sub(time.Now()))
 	}
+	return run.ctx.Err() == nil
 }
 
 func (run *UdpRun) getEndTime() (hasEndTime bool, endTime time.Time) {
@@ -82,66 +335,335 @@ func (run *UdpRun) getEndTime() (hasEndTime bool, endTime time.Time) {
 	return
 }
 
+func (run *UdpRun) trafficParams() *trafficParams {
+	return &trafficParams{
+		RunId:            run.Id,
+		Direction:        run.Req.Direction,
+		MaxBytes:         run.Req.MaxBytes,
+		WriteSize:        run.Req.WriteSize,
+		WriteIntervalMs:  run.Req.WriteIntervalMs,
+		EndTime:          run.Req.EndTime,
+		RateBps:          run.Req.RateBps,
+		PacketsPerSecond: run.Req.PacketsPerSecond,
+	}
+}
+
 func (run *UdpRun) Process() {
 	req := run.Req
+	defer func() {
+		run.mutex.Lock()
+		run.finish(run.ctx)
+		run.mutex.Unlock()
+	}()
 
-	raddr, err := net.ResolveUDPAddr("udp4", req.Target)
+	raddr, err := net.ResolveUDPAddr(familyNetwork("udp", req.AddressFamily), req.Target)
 	if err != nil {
 		glog.Errorf("Error resolving UDP address '%s': %s\n", req.Target, err)
+		run.abort(failureReason(err, FailureDns), err)
 		return
 	}
 
-	var laddr *net.UDPAddr = nil
-	conn, err := net.DialUDP("udp", laddr, raddr)
+	dialer := net.Dialer{
+		LocalAddr: sourceAddr("udp", req.SourceAddress, req.SourcePort),
+		Control:   run.controlSocket,
+	}
+	dialed, err := dialer.DialContext(run.ctx, "udp", raddr.String())
 	if err != nil {
 		glog.Errorf("Error opening socket to UDP target '%s': %s\n", req.Target, err)
+		run.abort(failureReason(err, FailureConnect), err)
 		return
 	}
+	conn := dialed.(*net.UDPConn)
+	defer conn.Close()
+	socketOptions := readSocketOptions(conn, false)
+	run.mutex.Lock()
+	if req.Timestamping != TimestampUser {
+		if rawConn, err := conn.SyscallConn(); err == nil {
+			run.tx = newTxTimestamps(rawConn)
+			run.SendTimestampSources = run.tx.sources
+			run.SendStackDelayUs = run.tx.delays
+		}
+	}
+	run.SocketOptions = socketOptions
+	run.RemoteAddr = raddr.String()
+	run.AddressFamily = addressFamily(raddr)
+	run.mutex.Unlock()
 
-	run.waitForStartTime()
-	glog.Infof("Beginning UDP traffic '%s'", run.Id)
+	// Every datagram must be large enough to carry the traffic header:
+	headerSize := uint64(udpHeaderSize(run.Id))
+	if req.WriteSize < headerSize {
+		glog.Infof("Increasing write size of UDP traffic '%s' to %d bytes to fit header",
+			run.Id, headerSize)
+		req.WriteSize = headerSize
+	}
 
-	hasEndTime, endTime := run.getEndTime()
+	if req.StartTime > 0 {
+		run.setState(RunWaitingForStart)
+	}
+	if !run.waitForStartTime() {
+		glog.Infof("UDP traffic run '%s' stopped before starting", run.Id)
+		return
+	}
+	params := run.trafficParams()
+	if params.Reverse() {
+		if err := sendUdpControl(run.writer(conn), udpPacketStart, run.Id, 0, params); err != nil {
+			glog.Errorf("Error requesting reverse traffic from UDP target '%s': %s\n",
+				req.Target, err)
+			run.abort(failureReason(err, FailureWriteError), err)
+			return
+		}
+	}
+	glog.Infof("Beginning %s UDP traffic '%s'", req.Direction, run.Id)
 
-	var data = make([]byte, req.WriteSize)
+	hasEndTime, endTime := run.getEndTime()
+	ctx, cancel := withEndTime(run.ctx, hasEndTime, endTime)
+	defer cancel()
+	stopInterrupt := interruptOnCancel(ctx, conn)
+	rcvbufErrorsStart := hostRcvbufErrors()
+	run.mutex.Lock()
 	run.TrafficStartTime = time.Now().UnixNano()
-	var lastSendTime time.Time
-	for {
-		if run.StopReq {
-			glog.Infof("Stopping UDP traffic run '%s'", run.Id)
-			break
-		}
-		if (req.MaxBytes > 0) && (run.BytesSent >= req.MaxBytes) {
-			glog.Infof("UDP traffic run '%s' completed (max bytes reached)", run.Id)
-			break
+	run.rcvbufErrorsStart = rcvbufErrorsStart
+	run.lastReport = intervalCounters{time: run.TrafficStartTime}
+	run.cancelTraffic = cancel
+	run.transition(RunRunning)
+	run.mutex.Unlock()
+	stopReports := startIntervalReports(
+		time.Duration(req.ReportIntervalMs)*time.Millisecond, run.reportInterval)
+	var wg sync.WaitGroup
+	receiveCtx, receiveDone := context.WithCancel(ctx)
+	defer receiveDone()
+	if params.Reverse() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer receiveDone()
+			run.receive(ctx, conn)
+		}()
+	}
+	// The forward traffic keeps the reverse traffic going, and keepalives take over once done.
+	// Both go through the same goroutine, for the transmit timestamps to match the datagrams.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if params.Forward() {
+			run.send(ctx, conn, headerSize)
 		}
-		if hasEndTime && time.Now().After(endTime) {
-			glog.Infof("UDP traffic run '%s' completed (time is over)", run.Id)
-			break
+		if params.Reverse() {
+			run.keepReverseAlive(receiveCtx, conn)
 		}
+	}()
+	wg.Wait()
+	stopReports()
 
-		if req.WriteIntervalMs > 0 {
-			var sleepTime = (time.Duration(req.WriteIntervalMs)*time.Millisecond -
-				time.Since(lastSendTime))
-			time.Sleep(sleepTime - time.Duration(1)*time.Millisecond)
+	// The socket remains usable to report the end of the traffic:
+	if !stopInterrupt() {
+		conn.SetDeadline(time.Time{})
+	}
+	rcvbufErrorsEnd := hostRcvbufErrors()
+	run.mutex.Lock()
+	packetsSent := run.PacketsSent
+	run.TrafficEndTime = time.Now().UnixNano()
+	run.rcvbufErrorsEnd = rcvbufErrorsEnd
+	run.mutex.Unlock()
+	sendUdpControl(run.writer(conn), udpPacketStop, run.Id, packetsSent, nil)
+	run.readTxTimestamps()
+
+	status := run.Snapshot()
+	deltaNS := status.TrafficEndTime - status.TrafficStartTime
+	glog.Infof("Completed UDP traffic request: %.03f b/s sent (%d bytes in %d packets in %d ns), "+
+		"%.03f b/s received (%d bytes in %d packets)",
+		status.SendRate, status.BytesSent, status.PacketsSent, deltaNS,
+		status.ReceiveRate, status.BytesReceived, status.PacketsReceived)
+}
+
+// Applies the socket options of the run to its socket before it connects.
+func (run *UdpRun) controlSocket(network, address string, rawConn syscall.RawConn) error {
+	if err := controlInterface(rawConn, run.Req.Interface); err != nil {
+		return err
+	}
+	if run.Req.Dscp > 0 {
+		if err := setDscp(rawConn, network, run.Req.Dscp); err != nil {
+			return err
 		}
-		lastSendTime = time.Now()
-		var buffer = data[0:req.WriteSize]
-		if req.MaxBytes > 0 {
-			buffer = buffer[0:min(req.WriteSize, req.MaxBytes-run.BytesSent)]
+	}
+	if run.Req.Timestamping != TimestampUser {
+		if err := enableTimestamping(rawConn, run.Req.Timestamping, true); err != nil {
+			return err
 		}
-		nbytes, err := conn.Write(buffer)
-		if err != nil {
-			glog.Errorf("Error sending data over UDP to '%s': %s\n", req.Target, err)
-			break
+	}
+	if run.Req.SocketOptions != nil {
+		return setSocketOptions(rawConn, run.Req.SocketOptions)
+	}
+	return nil
+}
+
+// Returns the function writing a single datagram to the socket of the run, which records it
+// for transmit timestamps.
+func (run *UdpRun) writer(conn *net.UDPConn) func([]byte) (int, error) {
+	if run.tx == nil {
+		return conn.Write
+	}
+	return func(datagram []byte) (int, error) {
+		nbytes, err := conn.Write(datagram)
+		if err == nil {
+			run.tx.Sent(datagram)
 		}
+		return nbytes, err
+	}
+}
+
+// Accounts for the transmit timestamps available, with kernel timestamping.
+func (run *UdpRun) readTxTimestamps() {
+	if run.tx == nil {
+		return
+	}
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	if err := run.tx.Read(); err != nil {
+		glog.V(1).Infof("Error reading transmit timestamps of UDP traffic '%s': %s", run.Id, err)
+	}
+}
+
+// Sends the forward traffic.
+func (run *UdpRun) send(ctx context.Context, conn *net.UDPConn, headerSize uint64) {
+	req := run.Req
+	name := fmt.Sprintf("UDP traffic run '%s'", run.Id)
+	var unreadTxTimestamps int
+	sent := func(packets int, nbytes int) {
+		run.mutex.Lock()
 		run.BytesSent += uint64(nbytes)
-		glog.V(1).Infof("Sent %d bytes (%d out of %d bytes) from %s to %s over UDP",
-			nbytes, run.BytesSent, req.MaxBytes, conn.LocalAddr(), raddr)
+		run.PacketsSent += uint64(packets)
+		run.lastSendTime = time.Now().UnixNano()
+		run.mutex.Unlock()
+		unreadTxTimestamps += packets
+		if unreadTxTimestamps >= txTimestampReadPeriod {
+			run.readTxTimestamps()
+			unreadTxTimestamps = 0
+		}
+	}
+	writeDatagram := run.writer(conn)
+	write := func(buffer []byte) error {
+		nbytes, err := writeDatagram(buffer)
+		if err == nil {
+			sent(1, nbytes)
+		}
+		return err
+	}
+	sendPath := UdpSendWrite
+	var batch *udpBatchSender
+	var flush func() error
+	if req.BatchSize > 1 {
+		batch = newUdpBatchSender(name, conn, int(req.BatchSize), int(req.WriteSize),
+			func(packets int, nbytes int) {
+				sent(packets, nbytes)
+				run.mutex.Lock()
+				run.SendPath = batch.path
+				run.mutex.Unlock()
+			})
+		if run.tx != nil {
+			batch.onSend = run.tx.Sent
+		}
+		write = batch.Queue
+		flush = batch.Flush
+		sendPath = batch.path
 	}
+	run.mutex.Lock()
+	run.SendPath = sendPath
+	run.mutex.Unlock()
 
-	run.TrafficEndTime = time.Now().UnixNano()
-	deltaNS := run.TrafficEndTime - run.TrafficStartTime
-	glog.Infof("Completed UDP traffic request: %.03f b/s (%d bytes in %d ns)",
-		float64(run.BytesSent)*1e9/float64(deltaNS), run.BytesSent, deltaNS)
+	var header = udpHeader{Kind: udpPacketData, RunId: run.Id}
+	loop := &sendLoop{
+		name:          name,
+		ctx:           ctx,
+		maxBytes:      req.MaxBytes,
+		writeSize:     req.WriteSize,
+		minWriteSize:  headerSize,
+		writeInterval: time.Duration(req.WriteIntervalMs) * time.Millisecond,
+		pacer:         newPacer(req.RateBps, req.PacketsPerSecond),
+		write: func(buffer []byte) (int, error) {
+			header.SendTime = time.Now().UnixNano()
+			header.Encode(buffer)
+			if err := write(buffer); err != nil {
+				return 0, err
+			}
+			header.Seq += 1
+			return len(buffer), nil
+		},
+		flush: flush,
+	}
+	_, err := loop.Run()
+	if err == nil && batch != nil && ctx.Err() == nil {
+		err = batch.Flush()
+	}
+	if err != nil {
+		glog.Errorf("Error sending data over UDP to '%s': %s\n", req.Target, err)
+		run.abort(failureReason(err, FailureWriteError), err)
+	}
+}
+
+// Sends keepalives to the target until ctx is done, so that it keeps sending the reverse
+// traffic.
+func (run *UdpRun) keepReverseAlive(ctx context.Context, conn *net.UDPConn) {
+	ticker := time.NewTicker(udpReverseKeepaliveInterval)
+	defer ticker.Stop()
+	write := run.writer(conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := sendUdpControl(write, udpPacketKeepalive, run.Id, 0, nil); err != nil {
+			glog.V(1).Infof("Error sending keepalive of UDP traffic '%s': %s", run.Id, err)
+		}
+	}
+}
+
+// Receives the reverse traffic, until the target reports it is done or stops sending.
+func (run *UdpRun) receive(ctx context.Context, conn *net.UDPConn) {
+	name := fmt.Sprintf("reverse UDP traffic run '%s'", run.Id)
+	var buffer = make([]byte, *flagUdpReadBufferSize)
+	var oob = make([]byte, dscpControlSize+timestampingControlSize)
+	var localAddr = conn.LocalAddr().String()
+	var remoteAddr = conn.RemoteAddr().String()
+	var header udpHeader
+	for {
+		// The deadline is pushed back on every packet, and overridden when ctx is done:
+		conn.SetReadDeadline(time.Now().Add(udpReverseIdleTimeout))
+		if trafficDone(ctx, name) {
+			return
+		}
+		nbytes, oobBytes, _, _, err := conn.ReadMsgUDP(buffer, oob)
+		info := newUdpPacketInfo(time.Now())
+		if err != nil {
+			if trafficDone(ctx, name) {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				glog.Infof("%s completed (no more traffic)", name)
+			} else {
+				glog.Errorf("Error receiving data over UDP from '%s': %s\n", run.Req.Target, err)
+				run.abort(failureReason(err, FailureReadError), err)
+			}
+			return
+		}
+		if err := header.Decode(buffer[0:nbytes]); err != nil || header.RunId != run.Id {
+			continue
+		}
+		switch header.Kind {
+		case udpPacketStop:
+			glog.Infof("%s completed", name)
+			udpRunFlows.Finish(remoteAddr, run.Id, header.Seq)
+			return
+		case udpPacketData:
+			parseUdpControl(oob[0:oobBytes], &info)
+			flowId := udpRunFlows.AddPacket(remoteAddr, localAddr, nbytes, &header, &info)
+			run.mutex.Lock()
+			run.BytesReceived += uint64(nbytes)
+			run.PacketsReceived += 1
+			run.lastReceiveTime = time.Now().UnixNano()
+			run.ReverseFlowId = flowId
+			run.mutex.Unlock()
+		}
+	}
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Time to wait for the kernel to complete pending sends, when too many are pending.
+const zerocopyRetryDelay = 100 * time.Microsecond
+
+// Sends buffers over a TCP connection with MSG_ZEROCOPY. The kernel reports on the error queue
+// of the socket once done with the pages of a buffer, which must not change until then: the
+// send loop writes the same, constant buffer over and over.
+type zerocopyWriter struct {
+	rawConn syscall.RawConn
+
+	// Room for the completion notifications read from the error queue.
+	oob []byte
+
+	// Sends the kernel completed by copying the data after all, e.g. over loopback.
+	copied uint64
+}
+
+func newZerocopyWriter(conn *net.TCPConn) (*zerocopyWriter, error) {
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		err = controlFd(rawConn, func(fd int) error {
+			return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+		})
+	}
+	if err != nil {
+		return nil, &socketOptionError{"SO_ZEROCOPY", err}
+	}
+	return &zerocopyWriter{rawConn: rawConn, oob: make([]byte, 1024)}, nil
+}
+
+func (w *zerocopyWriter) Write(buffer []byte) (int, error) {
+	for {
+		var nbytes int
+		var sendErr error
+		err := w.rawConn.Write(func(fd uintptr) bool {
+			nbytes, sendErr = unix.SendmsgN(
+				int(fd), buffer, nil, nil, unix.MSG_ZEROCOPY|unix.MSG_DONTWAIT)
+			return sendErr != unix.EAGAIN
+		})
+		if err == nil {
+			err = sendErr
+		}
+		completed := w.readCompletions()
+		if errors.Is(err, unix.ENOBUFS) {
+			// Too many sends are pending completion:
+			if completed == 0 {
+				time.Sleep(zerocopyRetryDelay)
+			}
+			continue
+		}
+		return nbytes, err
+	}
+}
+
+// Reads the completion notifications available on the error queue, and returns the number of
+// sends they complete.
+func (w *zerocopyWriter) readCompletions() uint64 {
+	var completed uint64
+	controlFd(w.rawConn, func(fd int) error {
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(fd, nil, w.oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				return err
+			}
+			messages, err := unix.ParseSocketControlMessage(w.oob[0:oobn])
+			if err != nil {
+				return err
+			}
+			for _, m := range messages {
+				isRecvErr := (m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) ||
+					(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR)
+				if !isRecvErr || len(m.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+					continue
+				}
+				ee := (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+				if ee.Origin != unix.SO_EE_ORIGIN_ZEROCOPY {
+					continue
+				}
+				// The notification covers the range of sends [Info, Data]:
+				sends := uint64(ee.Data-ee.Info) + 1
+				completed += sends
+				if ee.Code&unix.SO_EE_CODE_ZEROCOPY_COPIED != 0 {
+					w.copied += sends
+				}
+			}
+		}
+	})
+	return completed
+}
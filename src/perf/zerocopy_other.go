@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+type zerocopyWriter struct {
+	copied uint64
+}
+
+func newZerocopyWriter(conn *net.TCPConn) (*zerocopyWriter, error) {
+	return nil, &socketOptionError{"SO_ZEROCOPY", errSocketOptionUnsupported}
+}
+
+func (w *zerocopyWriter) Write(buffer []byte) (int, error) {
+	return 0, errSocketOptionUnsupported
+}